@@ -0,0 +1,50 @@
+package bot
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// backoff computes the delays between attempts at something that keeps failing, doubling each time up to a maximum
+// Up to half of each delay is randomly taken off, so that clients which failed together don't all retry together
+type backoff struct {
+	min, max time.Duration
+	random   func() float64
+
+	lock     sync.Mutex
+	attempts int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{
+		min:    min,
+		max:    max,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())).Float64, // nolint: gosec
+	}
+}
+
+// next returns how long to wait before the next attempt
+func (b *backoff) next() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delay := b.min
+	for i := 0; i < b.attempts && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.attempts++
+
+	return delay - time.Duration(b.random()*float64(delay/2))
+}
+
+// reset starts the delays again from the minimum, once an attempt has succeeded
+func (b *backoff) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.attempts = 0
+}
@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBackoff(t *testing.T) {
+	Convey("When a backoff is used", t, func() {
+		random := 0.0
+		b := newBackoff(time.Second, 10*time.Second)
+		b.random = func() float64 { return random }
+
+		Convey("It doubles the delay up to the maximum", func() {
+			So(b.next(), ShouldEqual, time.Second)
+			So(b.next(), ShouldEqual, 2*time.Second)
+			So(b.next(), ShouldEqual, 4*time.Second)
+			So(b.next(), ShouldEqual, 8*time.Second)
+			So(b.next(), ShouldEqual, 10*time.Second)
+			So(b.next(), ShouldEqual, 10*time.Second)
+		})
+
+		Convey("It takes off up to half of the delay as jitter", func() {
+			random = 0.5
+			So(b.next(), ShouldEqual, 750*time.Millisecond)
+			random = 0.99
+			So(b.next(), ShouldEqual, 1010*time.Millisecond)
+		})
+
+		Convey("It starts again from the minimum once reset", func() {
+			b.next()
+			b.next()
+			b.reset()
+			So(b.next(), ShouldEqual, time.Second)
+		})
+	})
+}
@@ -1,7 +1,11 @@
 package bot
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
@@ -11,32 +15,101 @@ import (
 
 // Config requires the required config to connect to IRC/Discord and the mapping between them
 type Config struct {
-	IRC     IRCConfig         `json:"irc"`
-	Discord DiscordConfig     `json:"discord"`
-	Mapping map[string]string `json:"mapping"`
+	IRC      IRCConfig                `json:"irc"`
+	Discord  DiscordConfig            `json:"discord"`
+	Mapping  map[string]string        `json:"mapping"`
+	Channels map[string]ChannelConfig `json:"channels"`
+	Store    StoreConfig              `json:"store"`
+}
+
+// ChannelConfig represents optional settings for a single mapping, keyed by IRC channel
+type ChannelConfig struct {
+	Key        string `json:"key"`
+	ANSIColors bool   `json:"ansi_colors"`
+
+	// RelayJoins, RelayParts, RelayQuits, RelayKicks and RelayNicks post a line to Discord when someone joins, leaves,
+	// quits, is kicked from or changes nick in the IRC channel
+	RelayJoins bool `json:"relay_joins"`
+	RelayParts bool `json:"relay_parts"`
+	RelayQuits bool `json:"relay_quits"`
+	RelayKicks bool `json:"relay_kicks"`
+	RelayNicks bool `json:"relay_nicks"`
+
+	// TopicSync is "to_discord" to mirror the IRC topic to the Discord channel topic, "to_irc" to push Discord topic
+	// changes to IRC, or "both"
+	TopicSync string `json:"topic_sync"`
+
+	// Webhooks posts IRC messages to Discord through a webhook, as each nick, rather than as the bot
+	Webhooks bool `json:"webhooks"`
+
+	// RelayDeletes is "note" to post a line to IRC when a relayed Discord message is deleted, or "redact" to delete
+	// the IRC message where the server supports it, posting a line otherwise
+	RelayDeletes string `json:"relay_deletes"`
+
+	// DiscordReplies posts IRC messages addressed to someone, e.g. "nick: message", as Discord replies to their last
+	// message
+	DiscordReplies bool `json:"discord_replies"`
 }
 
 var (
 	conf            Config
 	inverseMapping  map[string]string
 	modifiedMapping map[string]string
+	channelConfigs  map[string]ChannelConfig
 )
 
 // Init starts the bridge with the given config
 func Init(c Config) {
 	conf = c
+	initMappings()
+	checkWebhookAvatarURL()
+	initMessageStore(conf.Store)
+	dInit()
+	iInit()
+}
+
+// initMappings builds the lookup tables for the mapping and channel settings in the config
+func initMappings() {
 	inverseMapping = map[string]string{}
 	modifiedMapping = map[string]string{}
+	keys := map[string]string{}
 	for k, v := range conf.Mapping {
-		ircChannelPassword := strings.Split(k, " ") // "#channel password" -> ["#channel", "password"]
+		ircChannelPassword := strings.SplitN(k, " ", 2) // "#channel password" -> ["#channel", "password"]
 		ircChannel := ircChannelPassword[0]
 		inverseMapping[v] = ircChannel
 		modifiedMapping[ircChannel] = v
+		if len(ircChannelPassword) == 2 {
+			keys[strings.ToLower(ircChannel)] = ircChannelPassword[1]
+		}
+	}
+	channelConfigs = map[string]ChannelConfig{}
+	for k, v := range conf.Channels {
+		checkTopicSync(k, v)
+		checkRelayDeletes(k, v)
+		channelConfigs[strings.ToLower(k)] = v
+		if v.Key != "" {
+			keys[strings.ToLower(k)] = v.Key
+		}
+	}
+	iSetChannelKeys(keys)
+}
+
+// ircStatusNotice posts a notice about the state of the IRC connection to every mapped Discord channel
+var ircStatusNotice = func(message string) {
+	for discordChan := range inverseMapping {
+		dOutgoing("", discordChan, format.FormattedString{{Text: message, Format: format.Italic}}, true)
 	}
-	dInit()
-	iInit()
 }
 
+// discordTopic sets the topic of a mapped Discord channel, announcing the change instead if we aren't allowed to
+var discordTopic = dSetTopic
+
+// discordDelete deletes a copy of an IRC message we posted to Discord
+var discordDelete = dDeleteMessage
+
+// discordCode posts a code block from IRC to a mapped Discord channel
+var discordCode = dOutgoingCode
+
 // hasCommand checks for the existence of the configured command characters at the start of a message
 func hasCommand(message, commandChars string) bool {
 	firstRune, _ := utf8.DecodeRuneInString(message)
@@ -44,17 +117,21 @@ func hasCommand(message, commandChars string) bool {
 }
 
 // incomingIRC is called on every message from a mapped IRC channel and posts it to the configured Discord channel
-func incomingIRC(nick, channel, message string) {
-	log.Infof("IRC %s <%s> %s", channel, nick, message)
+// `msgID` is the message's IRCv3 msgid, or "" if it has none
+func incomingIRC(nick, channel, message, msgID string) {
+	fs := format.ParseIRC(message)
+	log.Infof("IRC %s <%s> %s", channel, nick, fs.RenderPlain())
 
 	discordChan, ok := modifiedMapping[channel]
 	if !ok {
 		return
 	}
 
-	log.Debugf("Mapping IRC:%s to DIS:%s", channel, discordChan)
+	log.Debugf("Mapping IRC:%s to DIS:%s: %s", channel, discordChan, fs.RenderANSI())
 
-	fs := format.ParseIRC(message)
+	if collectIRCCode(nick, discordChan, fs.RenderPlain()) {
+		return
+	}
 
 	if hasCommand(message, conf.IRC.CommandChars) {
 		dOutgoing(nick, discordChan, format.FormattedString{{Text: "Command sent by " + nick}}, true)
@@ -62,11 +139,132 @@ func incomingIRC(nick, channel, message string) {
 		return
 	}
 
-	dOutgoing(nick, discordChan, fs, false)
+	// Discord markdown has no colors, but they can be shown in an ANSI code block instead
+	if channelConfigs[channel].ANSIColors && fs.HasColor() {
+		dOutgoingCode(nick, discordChan, fs.DiscordANSICodeBlock())
+		return
+	}
+
+	replyTo := ""
+	if channelConfigs[channel].DiscordReplies {
+		if target, rest, ok := ircReplyTarget(discordChan, message); ok {
+			replyTo, fs = target.DiscordID, format.ParseIRC(rest)
+		}
+	}
+
+	dOutgoingRelay(nick, discordChan, fs, false, msgID, replyTo)
+}
+
+// incomingIRCRedact is called when `nick` deletes the message with msgid `msgID` from a mapped IRC channel, and deletes
+// its copy from the configured Discord channel
+func incomingIRCRedact(nick, channel, msgID string) {
+	if _, ok := modifiedMapping[channel]; !ok {
+		return
+	}
+
+	relayed, ok := relayedMessages.byIRCMsgID(msgID)
+	if !ok || !relayed.FromIRC {
+		return
+	}
+
+	log.Infof("IRC %s %s deleted message %s", channel, nick, msgID)
+	relayedMessages.remove(relayed.DiscordID)
+	discordDelete(relayed)
+}
+
+// incomingIRCDelete is called when a channel operator `op` in a mapped IRC channel asks for the most recent message from
+// `nick` to be deleted from Discord, and deletes it from the configured Discord channel, returning whether there was one
+func incomingIRCDelete(op, channel, nick string) bool {
+	discordChan, ok := modifiedMapping[channel]
+	if !ok {
+		return false
+	}
+
+	relayed, ok := relayedMessages.lastFrom(discordChan, nick, true)
+	if !ok {
+		return false
+	}
+
+	log.Infof("IRC %s %s deleted the last message from %s", channel, op, nick)
+	relayedMessages.remove(relayed.DiscordID)
+	discordDelete(relayed)
+	return true
+}
+
+// incomingIRCNotice is called on every NOTICE to a mapped IRC channel and posts it to the configured Discord channel,
+// with the nick in the "-nick-" style IRC clients show NOTICEs in
+func incomingIRCNotice(nick, channel, message string) {
+	fs := format.ParseIRC(message)
+	log.Infof("IRC %s -%s- %s", channel, nick, fs.RenderPlain())
+
+	discordChan, ok := modifiedMapping[channel]
+	if !ok {
+		return
+	}
+
+	log.Debugf("Mapping IRC:%s notice to DIS:%s: %s", channel, discordChan, fs.RenderANSI())
+
+	notice := append(format.FormattedString{{Text: fmt.Sprintf("-%s- ", nick), Format: format.Bold}}, fs...)
+	dOutgoing(nick, discordChan, notice, true)
+}
+
+// incomingIRCMembership is called when someone joins, leaves or changes nick in a mapped IRC channel, and posts
+// `message` describing it to the configured Discord channel
+func incomingIRCMembership(channel, message string) {
+	log.Infof("IRC %s %s", channel, message)
+
+	discordChan, ok := modifiedMapping[channel]
+	if !ok {
+		return
+	}
+
+	dOutgoing("", discordChan, format.FormattedString{{Text: message, Format: format.Italic}}, true)
+}
+
+// incomingIRCTopic is called when the topic of a mapped IRC channel is set by `nick`, or seen on joining it if `nick`
+// is "", and mirrors it to the configured Discord channel if the mapping synchronises topics that way
+// The topic is followed whichever way topics are synchronised, so that Discord only pushes a topic IRC doesn't have
+func incomingIRCTopic(channel, nick, topic string) {
+	discordChan, ok := modifiedMapping[channel]
+	if !ok {
+		return
+	}
+
+	topic = topicForDiscord(format.ParseIRC(topic).RenderPlain())
+	if !iTopics.fromIRC(channel, topic) || !channelConfigs[channel].syncsTopicToDiscord() {
+		return
+	}
+
+	log.Infof("Mapping IRC:%s topic to DIS:%s: %s", channel, discordChan, topic)
+	discordTopic(discordChan, nick, topic)
+}
+
+// incomingDiscordTopic is called when the topic of a mapped Discord channel changes, and pushes it to the configured
+// IRC channel if the mapping synchronises topics that way
+func incomingDiscordTopic(channel, topic string) {
+	ircChan, ok := inverseMapping[channel]
+	if !ok || !channelConfigs[strings.ToLower(ircChan)].syncsTopicToIRC() {
+		return
+	}
+
+	topic = topicForIRC(topic)
+	if !iTopics.fromDiscord(strings.ToLower(ircChan), topic) {
+		return
+	}
+
+	log.Infof("Mapping DIS:%s topic to IRC:%s: %s", channel, ircChan, topic)
+	iSetTopic(ircChan, topic)
 }
 
 // incomingDiscord is called on every message from a mapped Discord channel and posts it to the configured IRC channel
 func incomingDiscord(nick, channel, message string) {
+	incomingDiscordReply(nick, channel, "", message)
+}
+
+// incomingDiscordReply is incomingDiscord for a line of a message replying to another, described by `context` from
+// dReplyContext, or "" if it isn't a reply
+// The line alone decides whether it is a command, NOTICE or action; the context is only added to what is sent
+func incomingDiscordReply(nick, channel, context, message string) {
 	log.Infof("DIS %s <%s> %s", channel, nick, message)
 
 	ircChan, ok := inverseMapping[channel]
@@ -76,13 +274,215 @@ func incomingDiscord(nick, channel, message string) {
 
 	log.Debugf("Mapping DIS:%s to IRC:%s", channel, ircChan)
 
-	fs := format.ParseDiscord(message)
+	if command, lines, ok := discordReplyLines(nick, ircChan, context, message); ok {
+		iSendLines(command, nick, ircChan, lines)
+		return
+	}
+
+	sentBy := "Command sent by " + nick
+	if context != "" {
+		sentBy += " (" + context + ")"
+	}
+	iOutgoing(nick, ircChan, format.FormattedString{{Text: sentBy}}, true)
+	iOutgoing(nick, ircChan, format.ParseDiscord(message), true)
+}
+
+// discordReplyLines returns the IRC command and lines a line `message` from `nick` with the reply context `context` is
+// sent to `ircChan` as, or false if it is a command, which is sent anonymously after a line saying who sent it
+func discordReplyLines(nick, ircChan, context, message string) (string, []string, bool) {
+	if prefix := conf.Discord.NoticePrefix; prefix != "" && strings.HasPrefix(message, prefix) {
+		fs := withReplyContext(context, format.ParseDiscord(strings.TrimPrefix(message, prefix)))
+		return "NOTICE", iSplitMessage("NOTICE", nick, ircChan, fs, false), true
+	}
 
 	if hasCommand(message, conf.Discord.CommandChars) {
-		iOutgoing(nick, ircChan, format.FormattedString{{Text: "Command sent by " + nick}}, true)
-		iOutgoing(nick, ircChan, fs, true)
+		return "", nil, false
+	}
+
+	fs := format.ParseDiscord(message)
+	if action, ok := discordAction(fs); ok {
+		return "PRIVMSG", iActionLines(nick, ircChan, withReplyContext(context, action)), true
+	}
+	return "PRIVMSG", iSplitMessage("PRIVMSG", nick, ircChan, withReplyContext(context, fs), false), true
+}
+
+// incomingDiscordEdit is called when a message relayed from a mapped Discord channel is edited from `old` to `new`, and
+// posts the edit to the configured IRC channel, where the message has the IRCv3 msgid `msgID`, or "" if unknown
+// Short changes are sent as "s/old/new/"; otherwise the message is sent again, marked as edited
+func incomingDiscordEdit(nick, channel, old, new, msgID string) {
+	log.Infof("DIS %s <%s> edited: %s", channel, nick, new)
+
+	if _, ok := inverseMapping[channel]; !ok {
+		return
+	}
+	if hasCommand(old, conf.Discord.CommandChars) || hasCommand(new, conf.Discord.CommandChars) {
+		// Commands aren't sent again just because they were edited
+		return
+	}
+
+	if iEditMessage(nick, channel, msgID, new) {
+		return
+	}
+
+	if strings.Contains(old, "\n") || strings.Contains(new, "\n") {
+		incomingDiscord(nick, channel, ircEditedMarker)
+		dispatchMessageToIRC(nick, channel, new)
+		return
+	}
+
+	if substitution, ok := editSubstitution(old, new); ok {
+		incomingDiscord(nick, channel, substitution)
+		return
+	}
+	dispatchMessageToIRC(nick, channel, new+" "+ircEditedMarker)
+}
+
+// incomingDiscordDelete is called when messages relayed from `nick` in a mapped Discord channel are deleted, given the
+// IRCv3 msgids of the IRC messages, or "" where unknown, and tells the configured IRC channel if the mapping relays
+// deletions
+func incomingDiscordDelete(nick, channel string, msgIDs []string) {
+	ircChan, ok := inverseMapping[channel]
+	if !ok {
+		return
+	}
+	relay := channelConfigs[strings.ToLower(ircChan)].RelayDeletes
+	if relay == relayDeletesNone {
+		return
+	}
+
+	log.Infof("DIS %s <%s> deleted %d messages", channel, nick, len(msgIDs))
+
+	notes := 0
+	for _, msgID := range msgIDs {
+		if relay == relayDeletesRedact && iRedactMessage(nick, channel, msgID) {
+			continue
+		}
+		notes++
+	}
+
+	switch {
+	case notes == 1:
+		incomingDiscord(nick, channel, ircDeletedMarker)
+	case notes > 1:
+		incomingDiscord(nick, channel, fmt.Sprintf("[%d messages deleted]", notes))
+	}
+}
+
+// discordAction returns the text of a Discord /me message, which Discord sends as a message that is entirely italic
+func discordAction(fs format.FormattedString) (format.FormattedString, bool) {
+	action := format.FormattedString{}
+	italic := false
+	for _, span := range fs {
+		if span.Format&format.Italic == 0 {
+			if strings.TrimSpace(span.Text) != "" {
+				return nil, false
+			}
+		} else if strings.TrimSpace(span.Text) != "" {
+			italic = true
+		}
+
+		span.Format &^= format.Italic
+		action = append(action, span)
+	}
+	return action, italic
+}
+
+// incomingDiscordFormatted is called for preformatted lines from a mapped Discord channel, such as lines of a code block,
+// and posts them to the configured IRC channel
+func incomingDiscordFormatted(nick, channel string, fs format.FormattedString) {
+	log.Infof("DIS %s <%s> %s", channel, nick, fs.RenderPlain())
+
+	ircChan, ok := inverseMapping[channel]
+	if !ok {
 		return
 	}
 
 	iOutgoing(nick, ircChan, fs, false)
 }
+
+// ircCodeBlockTimeout is how long to wait for the next line of a code block from IRC before sending it anyway, since
+// it may never be closed, and later lines from the same nick are held back until it is sent
+var ircCodeBlockTimeout = 2 * time.Second
+
+// ircCodeBlockMaxLines is the most lines a code block from IRC collects; it is sent once it has that many, even if
+// it isn't closed, and the lines after it are relayed as usual
+const ircCodeBlockMaxLines = 30
+
+// ircCodeBlock is a code block being reassembled from consecutive IRC lines between ``` markers
+type ircCodeBlock struct {
+	nick        string
+	discordChan string
+	language    string
+	lines       []string
+	timer       *time.Timer
+}
+
+var (
+	ircCodeBlocks     = map[string]*ircCodeBlock{}
+	ircCodeBlocksLock sync.Mutex
+
+	codeLanguageRegex = regexp.MustCompile(`^[a-zA-Z0-9_+\-.#]*$`)
+)
+
+// collectIRCCode reassembles the lines an IRC user sends between ``` markers into a single Discord code block
+// It returns whether the message was consumed as part of a code block
+func collectIRCCode(nick, discordChan, text string) bool {
+	key := discordChan + " " + nick
+
+	ircCodeBlocksLock.Lock()
+	defer ircCodeBlocksLock.Unlock()
+
+	block, ok := ircCodeBlocks[key]
+	if !ok {
+		if !strings.HasPrefix(text, "```") {
+			return false
+		}
+		text = strings.TrimPrefix(text, "```")
+
+		block = &ircCodeBlock{nick: nick, discordChan: discordChan}
+		if codeLanguageRegex.MatchString(text) {
+			block.language = text
+			text = ""
+		}
+		ircCodeBlocks[key] = block
+		block.timer = time.AfterFunc(ircCodeBlockTimeout, func() {
+			ircCodeBlocksLock.Lock()
+			defer ircCodeBlocksLock.Unlock()
+
+			if ircCodeBlocks[key] == block {
+				log.Debugf("Code block from %s in DIS:%s timed out; sending what we have", nick, discordChan)
+				block.send(key)
+			}
+		})
+
+		if text == "" {
+			return true
+		}
+	}
+
+	closed := strings.HasSuffix(text, "```")
+	text = strings.TrimSuffix(text, "```")
+	if text != "" || !closed {
+		block.lines = append(block.lines, text)
+	}
+
+	if closed || len(block.lines) >= ircCodeBlockMaxLines {
+		block.send(key)
+	} else {
+		block.timer.Reset(ircCodeBlockTimeout)
+	}
+	return true
+}
+
+// send posts the code block to Discord; the caller must hold ircCodeBlocksLock
+func (b *ircCodeBlock) send(key string) {
+	b.timer.Stop()
+	delete(ircCodeBlocks, key)
+
+	code := strings.Join(b.lines, "\n")
+	if strings.TrimSpace(code) == "" {
+		return
+	}
+
+	discordCode(b.nick, b.discordChan, format.CodeBlock{Language: b.language, Text: code})
+}
@@ -0,0 +1,77 @@
+package bot
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+
+	"github.com/GinjaNinja32/DisGoIRC/format"
+)
+
+func TestDiscordAction(t *testing.T) {
+	tests := []struct {
+		message string
+		action  format.FormattedString
+		ok      bool
+	}{
+		{"_waves_", format.FormattedString{{Text: "waves"}}, true},
+		{"*waves*", format.FormattedString{{Text: "waves"}}, true},
+		{"_waves **hello**_", format.FormattedString{{Text: "waves "}, {Text: "hello", Format: format.Bold}}, true},
+		{"_waves_ hello", nil, false},
+		{"hello", nil, false},
+		{"**hello**", nil, false},
+		{"", nil, false},
+	}
+
+	Convey("When Discord messages are checked for /me", t, func() {
+		for _, test := range tests {
+			action, ok := discordAction(format.ParseDiscord(test.message))
+			So(ok, ShouldEqual, test.ok)
+			if test.ok {
+				So(action, ShouldResemble, test.action)
+			}
+		}
+	})
+}
+
+func TestCollectIRCCode(t *testing.T) {
+	Convey("When IRC lines are sent between ``` markers", t, func() {
+		sent := make(chan string, 10)
+		discordCode = func(nick, channel string, code format.CodeBlock) {
+			sent <- nick + " " + channel + " " + code.Language + ": " + code.Text
+		}
+		defer func() { discordCode = dOutgoingCode }()
+
+		Convey("They are sent to Discord as one code block once it is closed", func() {
+			So(collectIRCCode("someone", "guild#foo", "```go"), ShouldBeTrue)
+			So(collectIRCCode("someone", "guild#foo", "x := 1"), ShouldBeTrue)
+			So(collectIRCCode("other", "guild#foo", "hello"), ShouldBeFalse)
+			So(collectIRCCode("someone", "guild#foo", "y := x```"), ShouldBeTrue)
+			So(receive(sent), ShouldEqual, "someone guild#foo go: x := 1\ny := x")
+
+			So(collectIRCCode("someone", "guild#foo", "hello"), ShouldBeFalse)
+		})
+
+		Convey("A block that is never closed is sent once no more lines come", func() {
+			ircCodeBlockTimeout = 10 * time.Millisecond
+			defer func() { ircCodeBlockTimeout = 2 * time.Second }()
+
+			So(collectIRCCode("someone", "guild#foo", "```oops, that wasn't code"), ShouldBeTrue)
+			So(receive(sent), ShouldEqual, "someone guild#foo : oops, that wasn't code")
+
+			So(collectIRCCode("someone", "guild#foo", "hello"), ShouldBeFalse)
+		})
+
+		Convey("A block stops collecting lines once it is full", func() {
+			So(collectIRCCode("someone", "guild#foo", "```"), ShouldBeTrue)
+			for i := 1; i <= ircCodeBlockMaxLines; i++ {
+				So(collectIRCCode("someone", "guild#foo", fmt.Sprint(i)), ShouldBeTrue)
+			}
+			So(receive(sent), ShouldEndWith, fmt.Sprintf("\n%d", ircCodeBlockMaxLines))
+
+			So(collectIRCCode("someone", "guild#foo", "hello"), ShouldBeFalse)
+		})
+	})
+}
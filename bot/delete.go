@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+// Ways a mapping can relay the deletion of Discord messages to IRC, for ChannelConfig.RelayDeletes
+const (
+	relayDeletesNone   = ""
+	relayDeletesNote   = "note"
+	relayDeletesRedact = "redact"
+)
+
+const (
+	// ircMessageRedactionCap is the IRCv3 capability for deleting messages already sent with REDACT
+	// See https://ircv3.net/specs/extensions/message-redaction
+	ircMessageRedactionCap = "draft/message-redaction"
+
+	// ircDeletedMarker replaces a message deleted on Discord when it can't be redacted on IRC
+	ircDeletedMarker = "[message deleted]"
+)
+
+// checkRelayDeletes checks a mapping's RelayDeletes setting, which must be one of the ways of relaying deletions
+func checkRelayDeletes(channel string, c ChannelConfig) {
+	switch c.RelayDeletes {
+	case relayDeletesNone, relayDeletesNote, relayDeletesRedact:
+	default:
+		log.Fatalf("Unsupported relay_deletes %q for %s; use %q or %q",
+			c.RelayDeletes, channel, relayDeletesNote, relayDeletesRedact)
+	}
+}
+
+// iRedactMessage deletes the message with msgid `msgID` from `nick` on IRC, returning whether it could
+// This needs the server to support redaction, and to have told us the msgid of the message
+func iRedactMessage(nick, channel, msgID string) bool {
+	if msgID == "" || !iHasCap(ircMessageRedactionCap) {
+		return false
+	}
+	ircChan, ok := inverseMapping[channel]
+	if !ok {
+		return false
+	}
+
+	// "REDACT #channel :msgid" is the same as "REDACT #channel msgid"
+	iSendLines("REDACT", nick, ircChan, []string{msgID})
+	return true
+}
+
+// iRedact follows someone deleting a message in an IRC channel, e.g. ":op!op@host REDACT #foo msgid :reason"
+func iRedact(e *irc.Event) {
+	if len(e.Arguments) < 2 || iOwnMessage(e) {
+		return
+	}
+	incomingIRCRedact(e.Nick, strings.ToLower(e.Arguments[0]), e.Arguments[1])
+}
+
+// iDeleteCommand handles a channel operator asking us to delete the Discord copy of someone's most recent message,
+// e.g. "bridge: delete someone", returning whether the message was such a request
+func iDeleteCommand(e *irc.Event) bool {
+	channel := strings.ToLower(e.Arguments[0])
+	if _, ok := modifiedMapping[channel]; !ok {
+		return false
+	}
+
+	fields := strings.Fields(e.Message())
+	if len(fields) != 3 || !strings.EqualFold(fields[1], "delete") {
+		return false
+	}
+	addressed := strings.TrimRight(fields[0], ":,")
+	if addressed == fields[0] || !strings.EqualFold(addressed, iCurrentNick()) {
+		return false
+	}
+	if !iIsOp(channel, e.Nick) {
+		return false
+	}
+
+	if incomingIRCDelete(e.Nick, channel, fields[2]) {
+		iReply(e.Nick, fmt.Sprintf("Deleted the last message from %s in %s from Discord", fields[2], channel))
+	} else {
+		iReply(e.Nick, fmt.Sprintf("There is no recent message from %s in %s to delete from Discord", fields[2], channel))
+	}
+	return true
+}
+
+// iReply sends a NOTICE to `nick`, in answer to something they asked us
+func iReply(nick, message string) {
+	iQueueLines("", nick, []string{fmt.Sprintf("NOTICE %s :%s", nick, message)})
+}
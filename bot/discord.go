@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -42,6 +43,13 @@ type DiscordConfig struct {
 	ForwardEmbeds bool   `json:"forward_embeds"`
 	CommandChars  string `json:"command_chars"`
 
+	// NoticePrefix marks messages to send to IRC as a NOTICE rather than a PRIVMSG, e.g. "!notice "
+	NoticePrefix string `json:"notice_prefix"`
+
+	// WebhookAvatarURL is where the avatars of nicks posted through webhooks come from, with %s replaced by the
+	// hex SHA-256 of the lowercased nick
+	WebhookAvatarURL string `json:"webhook_avatar_url"`
+
 	MaxLines      int    `json:"max_lines"`
 	PasteFilepath string `json:"paste_filepath"`
 	PasteURL      string `json:"paste_url"`
@@ -92,7 +100,13 @@ func dInit() {
 		}
 	}
 
-	dSession.AddHandler(dMessageCreate)
+	dWebhooks = newWebhooks(dWebhookSession{dSession}, realClock{})
+
+	dSession.AddHandler(dMessageCreateEvent)
+	dSession.AddHandler(dMessageUpdate)
+	dSession.AddHandler(dMessageDelete)
+	dSession.AddHandler(dMessageDeleteBulk)
+	dSession.AddHandler(dChannelUpdate)
 
 	retryErrors("connect to Discord", dSession.Open)
 
@@ -105,32 +119,24 @@ func dInit() {
 	log.Infof("Connected to Discord")
 }
 
-func dMessageCreate(s *discord.Session, m *discord.MessageCreate) {
-	if m.Author.ID == dBotID {
+func dMessageCreate(s *discord.Session, m *discord.MessageCreate, reply dReply) {
+	if m.Author.ID == dBotID || dWebhooks.isOurs(m.WebhookID) {
 		return
 	}
 
-	c, err := s.Channel(m.ChannelID)
-	if err != nil {
-		log.Errorf("Failed to get channel for incoming message with CID %s: %s", m.ChannelID, err)
+	g, channel, ok := dMessageChannel(s, m.ChannelID)
+	if !ok {
 		return
 	}
 
-	guildID := c.GuildID
-
-	g, err := s.Guild(guildID)
-	if err != nil {
-		log.Errorf("Failed to get guild with ID %s: %s", guildID, err)
-		return
-	}
-
-	channel := fmt.Sprintf("%s#%s", g.Name, c.Name)
 	authorName := getDisplayNameForUser(m.Author, g.Members)
 
 	if m.Content != "" {
-		message := convertMentionsForIRC(g, m)
+		message := convertMentionsForIRC(g, m.Message)
+		context := dReplyContext(g, reply)
+		dRememberRelayed(channel, authorName, context, message, m.Message)
 
-		dispatchMessageToIRC(authorName, channel, message)
+		dispatchReplyToIRC(authorName, channel, context, message)
 	}
 	for _, a := range m.Attachments {
 		incomingDiscord(authorName, channel, a.ProxyURL)
@@ -142,12 +148,126 @@ func dMessageCreate(s *discord.Session, m *discord.MessageCreate) {
 	}
 }
 
+// dRememberRelayed records that the Discord message `m` from `nick` in the mapped channel `channel`, which reads
+// `message`, is being relayed to IRC with the reply context `context`, so that edits, deletions and replies to it can
+// be relayed too
+func dRememberRelayed(channel, nick, context, message string, m *discord.Message) {
+	ircChan, ok := inverseMapping[channel]
+	if !ok {
+		return
+	}
+
+	relayedMessages.save(relayedMessage{
+		Channel:       channel,
+		IRCChannel:    ircChan,
+		DiscordChanID: m.ChannelID,
+		DiscordID:     m.ID,
+		Nick:          nick,
+		Content:       message,
+		Time:          time.Now(),
+	})
+	iAwaitEcho(nick, ircChan, context, message, m.ID)
+}
+
+// dMessageUpdate relays edits of messages we relayed
+// Discord also sends an update when it unfurls a link into an embed, which has no content and is ignored
+func dMessageUpdate(s *discord.Session, m *discord.MessageUpdate) {
+	if m.Author == nil || m.Author.ID == dBotID || dWebhooks.isOurs(m.WebhookID) || m.Content == "" {
+		return
+	}
+
+	relayed, ok := relayedMessages.byDiscordID(m.ID)
+	if !ok || relayed.FromIRC {
+		return
+	}
+
+	g, _, ok := dMessageChannel(s, m.ChannelID)
+	if !ok {
+		return
+	}
+
+	message := convertMentionsForIRC(g, m.Message)
+	if message == relayed.Content {
+		return
+	}
+	if relayed, ok = relayedMessages.setContent(m.ID, message); !ok || message == relayed.Content {
+		return
+	}
+
+	incomingDiscordEdit(relayed.Nick, relayed.Channel, relayed.Content, message, relayed.IRCMsgID)
+}
+
+// dMessageDelete relays the deletion of a message we relayed, and forgets it
+func dMessageDelete(s *discord.Session, m *discord.MessageDelete) {
+	if relayed, ok := relayedMessages.byDiscordID(m.ID); ok {
+		relayedMessages.remove(m.ID)
+		if !relayed.FromIRC {
+			incomingDiscordDelete(relayed.Nick, relayed.Channel, []string{relayed.IRCMsgID})
+		}
+	}
+}
+
+// dMessageDeleteBulk relays the deletion of many messages at once, e.g. when a moderator purges a channel, with one line
+// for each author's messages rather than one for each message
+func dMessageDeleteBulk(s *discord.Session, m *discord.MessageDeleteBulk) {
+	authors := []string{}
+	deleted := map[string][]relayedMessage{}
+	for _, id := range m.Messages {
+		relayed, ok := relayedMessages.byDiscordID(id)
+		if !ok {
+			continue
+		}
+		relayedMessages.remove(id)
+		if relayed.FromIRC {
+			continue
+		}
+		if _, ok := deleted[relayed.Nick]; !ok {
+			authors = append(authors, relayed.Nick)
+		}
+		deleted[relayed.Nick] = append(deleted[relayed.Nick], relayed)
+	}
+
+	for _, nick := range authors {
+		msgIDs := []string{}
+		for _, relayed := range deleted[nick] {
+			msgIDs = append(msgIDs, relayed.IRCMsgID)
+		}
+		incomingDiscordDelete(nick, deleted[nick][0].Channel, msgIDs)
+	}
+}
+
+// dMessageChannel looks up the guild and "guild#channel" name of the channel with ID `chanID`, which a message was sent in
+func dMessageChannel(s *discord.Session, chanID string) (*discord.Guild, string, bool) {
+	c, err := s.Channel(chanID)
+	if err != nil {
+		log.Errorf("Failed to get channel for incoming message with CID %s: %s", chanID, err)
+		return nil, "", false
+	}
+
+	guildID := c.GuildID
+
+	g, err := s.Guild(guildID)
+	if err != nil {
+		log.Errorf("Failed to get guild with ID %s: %s", guildID, err)
+		return nil, "", false
+	}
+
+	return g, fmt.Sprintf("%s#%s", g.Name, c.Name), true
+}
+
+// dChannelUpdate follows changes to the topic of mapped channels
+func dChannelUpdate(s *discord.Session, u *discord.ChannelUpdate) {
+	if channel, ok := dChannelName(u.GuildID, u.ID); ok {
+		incomingDiscordTopic(channel, u.Topic)
+	}
+}
+
 func handleEmbed(e *discord.MessageEmbed, channel, authorName string) {
 	if e.Title == "" && e.Description == "" {
 		// Probably just a link - skip it
 		return
 	}
-	ircColor := colorToIRCCompatible(e.Color)
+	ircColor := format.NearestReadableIRCColor(e.Color)
 
 	description := linkRegex.ReplaceAllString(e.Description, "$1 <$2>")
 
@@ -165,16 +285,11 @@ func handleEmbed(e *discord.MessageEmbed, channel, authorName string) {
 
 	if description != "" {
 		lines := strings.Split(description, "\n")
-		lines, forceClip := clipLinesForIRC(lines)
-		if len(lines) > conf.Discord.MaxLines || forceClip {
+		counts, total := ircLineCounts(authorName, channel, parseDiscordLines(lines))
+		if total > conf.Discord.MaxLines {
 			url := pasteData(description)
 
-			n := conf.Discord.MaxLines - 1
-			if len(lines) < n {
-				n = len(lines)
-			}
-
-			outLines = append(outLines, lines[:n]...)
+			outLines = append(outLines, linesWithin(lines, counts, conf.Discord.MaxLines-1)...)
 			outLines = append(outLines, fmt.Sprintf("[full message: %s]", url))
 		} else {
 			outLines = append(outLines, lines...)
@@ -197,60 +312,7 @@ func handleEmbed(e *discord.MessageEmbed, channel, authorName string) {
 
 var linkRegex = regexp.MustCompile(`\[([^][]+)\]\(([^()]+)\)`)
 
-var ircColors = [][3]uint8{
-	//{0xFF, 0xFF, 0xFF},
-	//{0x00, 0x00, 0x00}, // don't use black or white
-	{0x00, 0x00, 0xAA},
-	{0x00, 0xAA, 0x00},
-	{0xFF, 0x55, 0x55},
-	{0xAA, 0x00, 0x00},
-	{0xAA, 0x00, 0xAA},
-	{0xFF, 0x55, 0x55},
-	{0xFF, 0xFF, 0x55},
-	{0x55, 0xFF, 0x55},
-	{0x00, 0xAA, 0xAA},
-	{0x55, 0xFF, 0xFF},
-	{0x55, 0x55, 0xFF},
-	{0xFF, 0x55, 0xFF},
-	{0x55, 0x55, 0x55},
-	{0xAA, 0xAA, 0xAA},
-}
-
-func squaredDifference(a, b uint8) (diff uint32) {
-	if a > b {
-		diff = uint32(a - b)
-	} else {
-		diff = uint32(b - a)
-	}
-
-	diff *= diff
-	return
-}
-
-func colorToIRCCompatible(color int) uint8 {
-	target := [3]uint8{
-		uint8(color >> 16),
-		uint8(color >> 8),
-		uint8(color),
-	}
-
-	minDistance := uint32(0xFFFFFFFF)
-	minIndex := uint8(0)
-	for i, col := range ircColors {
-		var distance uint32
-		for index := range target {
-			distance += squaredDifference(target[index], col[index])
-		}
-		if distance < minDistance {
-			minDistance = distance
-			minIndex = uint8(i) + 2
-		}
-	}
-
-	return minIndex
-}
-
-func convertMentionsForIRC(g *discord.Guild, m *discord.MessageCreate) string {
+func convertMentionsForIRC(g *discord.Guild, m *discord.Message) string {
 	message := m.Content
 
 	// Channels
@@ -295,70 +357,120 @@ func convertMentionsForIRC(g *discord.Guild, m *discord.MessageCreate) string {
 }
 
 func dispatchMessageToIRC(authorName, channel, message string) {
+	dispatchReplyToIRC(authorName, channel, "", message)
+}
+
+// dispatchReplyToIRC is dispatchMessageToIRC for a message replying to another, described by `context` from
+// dReplyContext, or "" if it isn't a reply; the context is sent with the first line
+func dispatchReplyToIRC(authorName, channel, context, message string) {
+	for _, block := range format.SplitDiscordCodeBlocks(message) {
+		if block.Code != nil {
+			if context != "" {
+				incomingDiscordReply(authorName, channel, context, "")
+			}
+			dispatchCodeBlockToIRC(authorName, channel, *block.Code)
+		} else {
+			dispatchLinesToIRC(authorName, channel, context, block.Text)
+		}
+		context = ""
+	}
+}
+
+func dispatchLinesToIRC(authorName, channel, context, message string) {
 	// Multiline
 	lines := strings.Split(message, "\n")
-	lines, forceClip := clipLinesForIRC(lines)
-	if len(lines) > conf.Discord.MaxLines || forceClip {
+	counts, total := ircLineCounts(authorName, channel, parseDiscordLines(lines))
+	if total > conf.Discord.MaxLines {
 		url := pasteData(message)
 
-		n := conf.Discord.MaxLines - 1
-		if len(lines) < n {
-			n = len(lines)
-		}
-
-		for _, line := range lines[:n] {
-			incomingDiscord(authorName, channel, line)
+		for _, line := range linesWithin(lines, counts, conf.Discord.MaxLines-1) {
+			incomingDiscordReply(authorName, channel, context, line)
+			context = ""
 		}
 		incomingDiscord("[SYSTEM]", channel, fmt.Sprintf("full message from %s: %s", iAddAntiPing(authorName), url))
 	} else {
 		for _, line := range lines {
-			incomingDiscord(authorName, channel, line)
+			incomingDiscordReply(authorName, channel, context, line)
+			context = ""
 		}
 	}
 }
 
-func clipLinesForIRC(s []string) ([]string, bool) {
-	ret := []string{}
-	anyLineForceClip := false
+func dispatchCodeBlockToIRC(authorName, channel string, code format.CodeBlock) {
+	lines := code.FormattedLines()
+	if _, total := ircLineCounts(authorName, channel, lines); total > conf.Discord.MaxLines {
+		// Code is never clipped; the full block is only available via the paste
+		url := pasteDataAs(code.Text, code.Language)
+		incomingDiscord("[SYSTEM]", channel, fmt.Sprintf("code from %s: %s", iAddAntiPing(authorName), url))
+		return
+	}
 
-	for _, line := range s {
-		if len(line) < 300 {
-			ret = append(ret, line)
-		} else {
-			words := strings.Split(line, " ")
-			for len(words) != 0 {
-				l := words[0]
-				words = words[1:]
-				for len(words) != 0 && len(l)+len(words[0]) < 300 {
-					l = l + " " + words[0]
-					words = words[1:]
-				}
-
-				anyLineForceClip = anyLineForceClip || len(l) > 300
-				ret = append(ret, l)
-			}
-		}
+	for _, line := range lines {
+		incomingDiscordFormatted(authorName, channel, line)
 	}
+}
+
+func parseDiscordLines(lines []string) []format.FormattedString {
+	parsed := []format.FormattedString{}
+	for _, line := range lines {
+		parsed = append(parsed, format.ParseDiscord(line))
+	}
+	return parsed
+}
 
-	return ret, anyLineForceClip
+// ircLineCounts returns how many IRC lines each of `lines` will take once relayed from `authorName` to the IRC channel
+// mapped to `channel`, after any that are too long for one IRC line are split up
+func ircLineCounts(authorName, channel string, lines []format.FormattedString) (counts []int, total int) {
+	ircChan := inverseMapping[channel]
+	for _, line := range lines {
+		n := len(iSplitMessage("PRIVMSG", authorName, ircChan, line, false))
+		counts = append(counts, n)
+		total += n
+	}
+	return
+}
+
+// linesWithin returns as many of `lines` from the start as fit in `budget` IRC lines, given their `counts` from ircLineCounts
+func linesWithin(lines []string, counts []int, budget int) []string {
+	for i, count := range counts {
+		if count > budget {
+			return lines[:i]
+		}
+		budget -= count
+	}
+	return lines
 }
 
 func pasteData(s string) string {
+	return pasteDataAs(s, "txt")
+}
+
+var pasteExtensionRegex = regexp.MustCompile(`[^a-zA-Z0-9_+-]`)
+
+// pasteDataAs pastes `s` with the given file extension, to allow syntax highlighting by language
+func pasteDataAs(s, extension string) string {
+	extension = pasteExtensionRegex.ReplaceAllString(extension, "")
+	if extension == "" {
+		extension = "txt"
+	}
+
 	h := sha256.Sum256([]byte(s))
 	b64 := base64.URLEncoding.EncodeToString(h[:])
 
-	err := ioutil.WriteFile(filepath.Join(conf.Discord.PasteFilepath, fmt.Sprintf("%s.txt", b64)), []byte(s), 0644)
+	err := ioutil.WriteFile(filepath.Join(conf.Discord.PasteFilepath, fmt.Sprintf("%s.%s", b64, extension)), []byte(s), 0644)
 	if err != nil {
 		return err.Error()
 	}
 
-	return fmt.Sprintf("%s/%s.txt", conf.Discord.PasteURL, b64)
+	return fmt.Sprintf("%s/%s.%s", conf.Discord.PasteURL, b64, extension)
 }
 
 var discordEscaper = strings.NewReplacer(
 	"\\", "\\\\",
 	"*", "\\*",
 	"_", "\\_",
+	"~", "\\~",
+	"|", "\\|",
 )
 
 // StringReplace represents a single string replacement
@@ -400,10 +512,74 @@ func (s StringReplaceGroup) Less(i, j int) bool {
 	return si < sj
 }
 
-func dOutgoing(nick, channel string, messageParsed format.FormattedString, anonymous bool) {
+// dChannelIDs looks up the guild and channel IDs for a mapped "guild#channel" name
+func dChannelIDs(channel string) (guildID, chanID string) {
 	chanParts := strings.Split(channel, "#")
-	guildID := dGuilds[chanParts[0]]
-	chanID := dGuildChans[chanParts[0]][chanParts[1]]
+	return dGuilds[chanParts[0]], dGuildChans[chanParts[0]][chanParts[1]]
+}
+
+// dChannelName looks up the "guild#channel" name of a channel from its guild and channel IDs
+func dChannelName(guildID, chanID string) (string, bool) {
+	for guild, id := range dGuilds {
+		if id != guildID {
+			continue
+		}
+		for name, id := range dGuildChans[guild] {
+			if id == chanID {
+				return guild + "#" + name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// dSetTopic sets the topic of a mapped Discord channel to a topic `nick` set on IRC, or seen on joining if `nick` is ""
+// If we aren't allowed to change the topic, the topic is announced in the channel instead
+func dSetTopic(channel, nick, topic string) {
+	_, chanID := dChannelIDs(channel)
+
+	go func() {
+		// ChannelEditComplex would also reset the channel's position, and can't clear the topic
+		endpoint := discord.EndpointChannel(chanID)
+		_, err := dSession.RequestWithBucketID("PATCH", endpoint, map[string]string{"topic": topic}, endpoint)
+		if err == nil {
+			return
+		}
+		if !isMissingPermissions(err) {
+			log.Errorf("Failed to set the topic of %s: %s", channel, err)
+			return
+		}
+
+		log.Warnf("Not allowed to set the topic of %s; announcing it instead", channel)
+		announcement := fmt.Sprintf("IRC topic: %s", topic)
+		if nick != "" {
+			announcement = fmt.Sprintf("%s changed the IRC topic to: %s", nick, topic)
+		}
+		dOutgoing("", channel, format.FormattedString{{Text: announcement, Format: format.Italic}}, true)
+	}()
+}
+
+// isMissingPermissions returns whether `err`, from a Discord request, means the bot isn't allowed to do that
+func isMissingPermissions(err error) bool {
+	restErr, ok := err.(*discord.RESTError)
+	if !ok {
+		return false
+	}
+	if restErr.Message != nil {
+		return restErr.Message.Code == discord.ErrCodeMissingPermissions
+	}
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden
+}
+
+func dOutgoing(nick, channel string, messageParsed format.FormattedString, anonymous bool) {
+	dOutgoingRelay(nick, channel, messageParsed, anonymous, "", "")
+}
+
+// dOutgoingRelay is dOutgoing for a message relayed from IRC with the IRCv3 msgid `msgID`, or "" if it has none
+// The copy posted is remembered, so that it can be deleted when the IRC message is redacted
+// If `replyTo` is a Discord message ID, the copy is posted by the bot as a reply to it, since webhooks can't reply
+func dOutgoingRelay(nick, channel string, messageParsed format.FormattedString, anonymous bool, msgID, replyTo string) {
+	guildID, chanID := dChannelIDs(channel)
 	outgoingMessage := ""
 
 	g, err := dSession.Guild(guildID)
@@ -460,14 +636,54 @@ func dOutgoing(nick, channel string, messageParsed format.FormattedString, anony
 		outgoingMessage = fmt.Sprintf("**<%s>** %s", nick, message)
 	}
 
+	webhook := !anonymous && replyTo == "" && dUsesWebhooks(channel)
+	relayed := relayedMessage{FromIRC: true, Channel: channel, IRCChannel: inverseMapping[channel], DiscordChanID: chanID,
+		IRCMsgID: msgID, Nick: nick, Content: messageParsed.RenderPlain()}
 	dMsgQueue <- func() {
-		_, err := dSession.ChannelMessageSend(chanID, outgoingMessage)
+		if webhook {
+			if id, ok := dWebhooks.send(chanID, nick, message); ok {
+				dRememberCopy(relayed, id)
+				return
+			}
+		}
+
+		m, err := dSendMessage(chanID, outgoingMessage, replyTo)
 		if err != nil {
 			log.Errorf("Failed to send message to %s: <%s> %s", chanID, nick, message)
+			return
+		}
+		if !anonymous {
+			dRememberCopy(relayed, m.ID)
 		}
 	}
 }
 
+// dOutgoingCode posts a code block to Discord, prefixed with the provided nick
+// Unlike dOutgoing, no mentions are converted, since the code is displayed verbatim
+func dOutgoingCode(nick, channel string, code format.CodeBlock) {
+	_, chanID := dChannelIDs(channel)
+	outgoingMessage := fmt.Sprintf("**<%s>**\n%s", nick, code.RenderDiscord())
+
+	webhook := dUsesWebhooks(channel)
+	relayed := relayedMessage{FromIRC: true, Channel: channel, IRCChannel: inverseMapping[channel], DiscordChanID: chanID,
+		Nick: nick, Content: code.Text}
+	dMsgQueue <- func() {
+		if webhook {
+			if id, ok := dWebhooks.send(chanID, nick, code.RenderDiscord()); ok {
+				dRememberCopy(relayed, id)
+				return
+			}
+		}
+
+		m, err := dSession.ChannelMessageSend(chanID, outgoingMessage)
+		if err != nil {
+			log.Errorf("Failed to send code block to %s: <%s> %d lines", chanID, nick, len(code.Lines()))
+			return
+		}
+		dRememberCopy(relayed, m.ID)
+	}
+}
+
 func getDisplayNameForMember(member *discord.Member) string {
 	if conf.Discord.UseNicknames && member.Nick != "" {
 		return member.Nick
@@ -487,3 +703,24 @@ func getDisplayNameForUser(user *discord.User, members []*discord.Member) string
 
 	return user.Username
 }
+
+// dRememberCopy records the message with ID `id` we posted to Discord as the copy of the IRC message `relayed`, unless
+// we couldn't tell which message it was
+func dRememberCopy(relayed relayedMessage, id string) {
+	if id == "" {
+		return
+	}
+
+	relayed.DiscordID = id
+	relayed.Time = time.Now()
+	relayedMessages.save(relayed)
+}
+
+// dDeleteMessage deletes the copy of an IRC message we posted to Discord, after any messages waiting to be posted
+func dDeleteMessage(m relayedMessage) {
+	dMsgQueue <- func() {
+		if err := dSession.ChannelMessageDelete(m.DiscordChanID, m.DiscordID); err != nil {
+			log.Errorf("Failed to delete message %s from %s: %s", m.DiscordID, m.DiscordChanID, err)
+		}
+	}
+}
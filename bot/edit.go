@@ -0,0 +1,194 @@
+package bot
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	irc "github.com/thoj/go-ircevent"
+
+	"github.com/GinjaNinja32/DisGoIRC/format"
+)
+
+const (
+	// iAwaitedEchoCount is how many of our own IRC lines we wait for the server to echo back, to learn their msgid
+	iAwaitedEchoCount = 1000
+
+	// ircMessageEditCap is the IRCv3 capability for editing messages already sent, and ircEditTag the client tag
+	// naming the msgid of the message an edit replaces
+	ircMessageEditCap = "draft/message-edit"
+	ircEditTag        = "+draft/edit"
+
+	// ircEditedMarker marks a message re-sent to IRC because it was edited on Discord
+	ircEditedMarker = "(edited)"
+)
+
+// recentMessages remembers the most recent values stored in it, forgetting the oldest once it holds `limit`
+// Values stored under the same key are queued, and forgotten in the order they were stored
+type recentMessages struct {
+	limit int
+
+	lock   sync.Mutex
+	order  []string // The key of every value held, oldest first
+	values map[string][]string
+}
+
+func newRecentMessages(limit int) *recentMessages {
+	return &recentMessages{limit: limit, values: map[string][]string{}}
+}
+
+func (r *recentMessages) remember(key, value string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.order = append(r.order, key)
+	r.values[key] = append(r.values[key], value)
+
+	for len(r.order) > r.limit {
+		r.dropOldest(r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// forget removes the oldest value of `key`, returning it if there was one
+func (r *recentMessages) forget(key string) (string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	values := r.values[key]
+	if len(values) == 0 {
+		return "", false
+	}
+	r.dropOldest(key)
+	for i, k := range r.order {
+		if k == key {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+	return values[0], true
+}
+
+// dropOldest removes the oldest value of `key`, which must have one, leaving r.order to the caller
+func (r *recentMessages) dropOldest(key string) {
+	if values := r.values[key]; len(values) > 1 {
+		r.values[key] = values[1:]
+	} else {
+		delete(r.values, key)
+	}
+}
+
+// iAwaitedEchoes holds the Discord message IDs of messages we relayed to IRC as a single line, keyed by iSentLineKey,
+// until the server echoes the line back with its msgid
+// Messages sent as the same line are queued, since the server echoes lines in the order we sent them
+var iAwaitedEchoes = newRecentMessages(iAwaitedEchoCount)
+
+// iSentLineKey identifies a line we sent to an IRC channel with `command`
+func iSentLineKey(command, channel, line string) string {
+	return command + " " + strings.ToLower(channel) + " " + line
+}
+
+// iAwaitEcho prepares to record the msgid the server gives the message with the Discord message ID `discordID`, which
+// is being relayed from `nick` to `ircChan` with the reply context `context`, if it is relayed as a single line
+// Commands are sent as two lines, after the line saying who sent them, so they are never awaited
+func iAwaitEcho(nick, ircChan, context, message, discordID string) {
+	if !iHasCap("echo-message") || strings.Contains(message, "\n") {
+		return
+	}
+	command, lines, ok := discordReplyLines(nick, ircChan, context, message)
+	if ok && len(lines) == 1 {
+		iAwaitedEchoes.remember(iSentLineKey(command, ircChan, lines[0]), discordID)
+	}
+}
+
+// iRememberMsgID records the msgid of one of our own messages, echoed back to us by the server, which we sent with
+// `command` as `line`
+func iRememberMsgID(e *irc.Event, command, line string) {
+	msgID := e.Tags["msgid"]
+	if msgID == "" {
+		return
+	}
+	id, ok := iAwaitedEchoes.forget(iSentLineKey(command, e.Arguments[0], line))
+	if !ok {
+		return
+	}
+	relayedMessages.setIRCMsgID(id, msgID)
+}
+
+// iEditMessage edits the message with msgid `msgID` from `nick` on IRC to read `new`, returning whether it could
+// This needs the server to support editing messages, and to have told us the msgid of the original message
+func iEditMessage(nick, channel, msgID, new string) bool {
+	if msgID == "" || !iHasCap(ircMessageEditCap) || !iHasCap("message-tags") {
+		return false
+	}
+	ircChan, ok := inverseMapping[channel]
+	if !ok || strings.Contains(new, "\n") {
+		return false
+	}
+
+	lines := iSplitMessage("PRIVMSG", nick, ircChan, format.ParseDiscord(new), false)
+	if len(lines) != 1 {
+		return false
+	}
+
+	iSendTaggedLines(ircEditTag+"="+msgID, "PRIVMSG", nick, ircChan, lines)
+	return true
+}
+
+// editSubstitution describes the change from `old` to `new` as "s/old words/new words/", returning whether that is
+// shorter than just sending `new` again
+// The change is widened to whole words, so it can be read on its own
+func editSubstitution(old, new string) (string, bool) {
+	if old == new {
+		return "", false
+	}
+
+	o, n := []rune(old), []rune(new)
+
+	prefix := 0
+	for prefix < len(o) && prefix < len(n) && o[prefix] == n[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(o)-prefix && suffix < len(n)-prefix && o[len(o)-1-suffix] == n[len(n)-1-suffix] {
+		suffix++
+	}
+
+	// Widen to the start and end of the words the change touches
+	for prefix > 0 && !unicode.IsSpace(o[prefix-1]) {
+		prefix--
+	}
+	for suffix > 0 && !unicode.IsSpace(o[len(o)-suffix]) {
+		suffix--
+	}
+
+	// Words only added have nothing to replace, so take in the word after them, or failing that the one before
+	if len(o)-suffix == prefix {
+		for suffix > 0 && unicode.IsSpace(o[len(o)-suffix]) {
+			suffix--
+		}
+		for suffix > 0 && !unicode.IsSpace(o[len(o)-suffix]) {
+			suffix--
+		}
+	}
+	if len(o)-suffix == prefix {
+		for prefix > 0 && unicode.IsSpace(o[prefix-1]) {
+			prefix--
+		}
+		for prefix > 0 && !unicode.IsSpace(o[prefix-1]) {
+			prefix--
+		}
+	}
+
+	from := string(o[prefix : len(o)-suffix])
+	to := string(n[prefix : len(n)-suffix])
+	if strings.TrimSpace(from) == "" || strings.Contains(from, "/") || strings.Contains(to, "/") {
+		return "", false
+	}
+
+	substitution := "s/" + from + "/" + to + "/"
+	if len(substitution) >= len(new) {
+		return "", false
+	}
+	return substitution, true
+}
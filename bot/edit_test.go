@@ -0,0 +1,80 @@
+package bot
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEditSubstitution(t *testing.T) {
+	tests := []struct {
+		old, new     string
+		substitution string
+		ok           bool
+	}{
+		{"I think teh cat is asleep", "I think the cat is asleep", "s/teh/the/", true},
+		{"I like cats a great deal", "I like dogs a great deal", "s/cats/dogs/", true},
+		{"it was a really good day out", "it was a really great day out", "s/good/great/", true},
+		{"hello world, how are you all?", "hello big world, how are you all?", "s/world,/big world,/", true},
+		{"hello world, how are you all doing", "hello world, how are you all doing today", "s/doing/doing today/", true},
+		{"one two three four five six", "one two three four five six", "", false},
+		{"teh cat", "the cat", "", false},
+		{"see http://a.example/x for more", "see http://b.example/x for more", "", false},
+		{"something quite different", "nothing alike at all", "", false},
+	}
+
+	Convey("When edits are described as substitutions", t, func() {
+		for _, test := range tests {
+			Convey(fmt.Sprintf("%q to %q", test.old, test.new), func() {
+				substitution, ok := editSubstitution(test.old, test.new)
+				So(ok, ShouldEqual, test.ok)
+				So(substitution, ShouldEqual, test.substitution)
+			})
+		}
+	})
+}
+
+func TestRecentMessages(t *testing.T) {
+	Convey("When messages are remembered", t, func() {
+		r := newRecentMessages(3)
+		r.remember("1", "one")
+		r.remember("2", "two")
+		r.remember("1", "uno")
+		r.remember("3", "three")
+
+		Convey("Only the most recent are kept", func() {
+			uno, ok := r.forget("1")
+			So(ok, ShouldBeTrue)
+			So(uno, ShouldEqual, "uno")
+			_, ok = r.forget("1")
+			So(ok, ShouldBeFalse)
+
+			two, ok := r.forget("2")
+			So(ok, ShouldBeTrue)
+			So(two, ShouldEqual, "two")
+
+			three, ok := r.forget("3")
+			So(ok, ShouldBeTrue)
+			So(three, ShouldEqual, "three")
+		})
+
+		Convey("Values with the same key are forgotten oldest first", func() {
+			r.remember("3", "tres")
+
+			three, ok := r.forget("3")
+			So(ok, ShouldBeTrue)
+			So(three, ShouldEqual, "three")
+			three, ok = r.forget("3")
+			So(ok, ShouldBeTrue)
+			So(three, ShouldEqual, "tres")
+		})
+
+		Convey("Forgotten values are gone", func() {
+			_, ok := r.forget("2")
+			So(ok, ShouldBeTrue)
+			_, ok = r.forget("2")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,287 @@
+package bot
+
+import (
+	"expvar"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ircDefaultTargetRate and ircDefaultTargetBurst limit lines to each channel unless configured, leaving room in the
+	// global limit for other channels while one is busy
+	ircDefaultTargetRate  = 0.5
+	ircDefaultTargetBurst = 3
+
+	// ircDefaultGlobalRate and ircDefaultGlobalBurst limit lines to the server unless configured, staying under the
+	// limits at which servers disconnect clients for flooding
+	ircDefaultGlobalRate  = 1
+	ircDefaultGlobalBurst = 5
+
+	// ircShortMessageLines is the most lines a message can have to jump ahead of longer ones in the send queue
+	ircShortMessageLines = 1
+
+	// ircMaxQueueDepth is the most lines the send queue holds; messages which would take it past that are dropped
+	ircMaxQueueDepth = 1000
+
+	// ircTargetSweepInterval is how often the send queue forgets the limits of targets which are back to a full burst
+	// with nothing waiting, which are no different from a target never sent to
+	ircTargetSweepInterval = time.Minute
+)
+
+// clock is the source of time for flood control, which tests replace with a fake one
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// tokenBucket limits the rate of something to `rate` per second, allowing bursts of up to `burst` at once
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) fill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// wait returns how long from `now` until a token is available, or 0 if one is
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+	b.fill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// full returns whether the bucket has refilled to its burst by `now`
+func (b *tokenBucket) full(now time.Time) bool {
+	b.fill(now)
+	return b.tokens >= b.burst
+}
+
+// take uses up a token, going into debt if none is available
+func (b *tokenBucket) take(now time.Time) {
+	b.fill(now)
+	b.tokens--
+}
+
+// sendQueue holds lines waiting to be sent to IRC, sending each once both its target's bucket and the global bucket
+// allow it, so that long messages and pastes can't get us disconnected for flooding
+// Short messages from senders with nothing else waiting jump ahead of the rest, so conversation continues during a paste
+type sendQueue struct {
+	clock       clock
+	targetRate  float64
+	targetBurst int
+	wake        chan struct{}
+
+	depth, sent *expvar.Int
+	targetDepth *expvar.Map
+
+	lock              sync.Mutex
+	global            *tokenBucket
+	targets           map[string]*tokenBucket
+	lastSweep         time.Time
+	urgent, bulk      []*queuedLine
+	waitingFromSender map[string]int
+	waitingForTarget  map[string]int
+}
+
+// queuedLine is a line waiting in a sendQueue, with the function which sends it
+type queuedLine struct {
+	sender, target string
+	send           func()
+}
+
+// newSendQueue returns a send queue limited by `c`, publishing its depth and the number of lines sent to `metrics`
+func newSendQueue(c IRCConfig, clk clock, metrics *expvar.Map) *sendQueue {
+	q := &sendQueue{
+		clock:       clk,
+		targetRate:  configuredRate(c.FloodRate, ircDefaultTargetRate),
+		targetBurst: configuredBurst(c.FloodBurst, ircDefaultTargetBurst),
+		global: newTokenBucket(configuredRate(c.FloodGlobalRate, ircDefaultGlobalRate),
+			configuredBurst(c.FloodGlobalBurst, ircDefaultGlobalBurst), clk.Now()),
+		depth:             new(expvar.Int),
+		sent:              new(expvar.Int),
+		targetDepth:       new(expvar.Map).Init(),
+		wake:              make(chan struct{}, 1),
+		targets:           map[string]*tokenBucket{},
+		lastSweep:         clk.Now(),
+		waitingFromSender: map[string]int{},
+		waitingForTarget:  map[string]int{},
+	}
+	metrics.Set("depth", q.depth)
+	metrics.Set("sent", q.sent)
+	metrics.Set("target_depth", q.targetDepth)
+	return q
+}
+
+func configuredRate(rate, otherwise float64) float64 {
+	if rate > 0 {
+		return rate
+	}
+	return otherwise
+}
+
+func configuredBurst(burst, otherwise int) int {
+	if burst > 0 {
+		return burst
+	}
+	return otherwise
+}
+
+// push queues the lines of a message from `sender` to `target`, given as the functions which send them
+// The message is dropped if the queue is full
+func (q *sendQueue) push(sender, target string, sends []func()) {
+	q.lock.Lock()
+	if len(q.urgent)+len(q.bulk)+len(sends) > ircMaxQueueDepth {
+		q.lock.Unlock()
+		log.Errorf("IRC send queue is full; dropped %d lines to %s", len(sends), target)
+		return
+	}
+	queue := &q.bulk
+	if len(sends) <= ircShortMessageLines && q.waitingFromSender[sender] == 0 {
+		queue = &q.urgent
+	}
+	for _, send := range sends {
+		*queue = append(*queue, &queuedLine{sender: sender, target: target, send: send})
+	}
+	q.waitingFromSender[sender] += len(sends)
+	q.waitingForTarget[target] += len(sends)
+	q.depth.Add(int64(len(sends)))
+	q.targetDepth.Add(target, int64(len(sends)))
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the first line which may be sent at `now`, or if none may, returns how long until one might
+// The wait is 0 if the queue is empty
+func (q *sendQueue) next(now time.Time) (*queuedLine, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if now.Sub(q.lastSweep) >= ircTargetSweepInterval {
+		q.sweepTargets(now)
+	}
+
+	wait := time.Duration(0)
+	for _, queue := range []*[]*queuedLine{&q.urgent, &q.bulk} {
+		for i, line := range *queue {
+			target, ok := q.targets[line.target]
+			if !ok {
+				target = newTokenBucket(q.targetRate, q.targetBurst, now)
+				q.targets[line.target] = target
+			}
+
+			lineWait := target.wait(now)
+			if globalWait := q.global.wait(now); globalWait > lineWait {
+				lineWait = globalWait
+			}
+			if lineWait == 0 {
+				target.take(now)
+				q.global.take(now)
+				*queue = append((*queue)[:i], (*queue)[i+1:]...)
+				q.sentLine(line)
+				return line, 0
+			}
+			if wait == 0 || lineWait < wait {
+				wait = lineWait
+			}
+		}
+	}
+	return nil, wait
+}
+
+// sweepTargets forgets the limits of targets which have refilled to a full burst and have nothing waiting, since a new
+// bucket would be the same, so the queue doesn't keep one for every nick ever replied to
+func (q *sendQueue) sweepTargets(now time.Time) {
+	for target, bucket := range q.targets {
+		if q.waitingForTarget[target] == 0 && bucket.full(now) {
+			delete(q.targets, target)
+		}
+	}
+	q.lastSweep = now
+}
+
+// takeGlobal uses up a token from the global bucket for a line sent without waiting in the queue, such as one sent
+// while registering, so that the lines waiting after it are held back to make up for it
+func (q *sendQueue) takeGlobal() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.global.take(q.clock.Now())
+}
+
+// clear drops every line waiting in the queue, returning how many there were
+func (q *sendQueue) clear() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	dropped := len(q.urgent) + len(q.bulk)
+	for _, queue := range [][]*queuedLine{q.urgent, q.bulk} {
+		for _, line := range queue {
+			q.targetDepth.Add(line.target, -1)
+		}
+	}
+	q.urgent, q.bulk = nil, nil
+	q.waitingFromSender = map[string]int{}
+	q.waitingForTarget = map[string]int{}
+	q.depth.Add(int64(-dropped))
+	return dropped
+}
+
+// sentLine updates the counts of waiting lines once `line` is taken from the queue to be sent
+func (q *sendQueue) sentLine(line *queuedLine) {
+	q.waitingFromSender[line.sender]--
+	if q.waitingFromSender[line.sender] == 0 {
+		delete(q.waitingFromSender, line.sender)
+	}
+	q.waitingForTarget[line.target]--
+	if q.waitingForTarget[line.target] == 0 {
+		delete(q.waitingForTarget, line.target)
+	}
+	q.depth.Add(-1)
+	q.targetDepth.Add(line.target, -1)
+	q.sent.Add(1)
+}
+
+// run sends queued lines as the rate limits allow, until `quit` is closed
+func (q *sendQueue) run(quit <-chan struct{}) {
+	for {
+		line, wait := q.next(q.clock.Now())
+		if line != nil {
+			line.send()
+			continue
+		}
+
+		var ready <-chan time.Time
+		if wait != 0 {
+			ready = q.clock.After(wait)
+		}
+		select {
+		case <-ready:
+		case <-q.wake:
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package bot
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeClock is a clock which only moves when advanced
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	timer := fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+// advance moves the clock on by `d`, firing any timers which are then due
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := []fakeTimer{}
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// waitForTimer waits until something is waiting for the clock, so that advancing it will wake them
+func (c *fakeClock) waitForTimer() bool {
+	for deadline := time.Now().Add(fakeIRCTimeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.lock.Lock()
+		waiting := len(c.timers) != 0
+		c.lock.Unlock()
+		if waiting {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTokenBucket(t *testing.T) {
+	Convey("When a token bucket is used", t, func() {
+		clk := newFakeClock()
+		b := newTokenBucket(2, 3, clk.Now())
+
+		Convey("It allows a burst, then limits the rate", func() {
+			for i := 0; i < 3; i++ {
+				So(b.wait(clk.Now()), ShouldEqual, 0)
+				b.take(clk.Now())
+			}
+			So(b.wait(clk.Now()), ShouldEqual, 500*time.Millisecond)
+
+			clk.advance(200 * time.Millisecond)
+			So(b.wait(clk.Now()), ShouldEqual, 300*time.Millisecond)
+
+			clk.advance(300 * time.Millisecond)
+			So(b.wait(clk.Now()), ShouldEqual, 0)
+		})
+
+		Convey("It refills no further than the burst", func() {
+			b.take(clk.Now())
+			clk.advance(time.Hour)
+			for i := 0; i < 3; i++ {
+				So(b.wait(clk.Now()), ShouldEqual, 0)
+				b.take(clk.Now())
+			}
+			So(b.wait(clk.Now()), ShouldEqual, 500*time.Millisecond)
+		})
+	})
+}
+
+// sendRecorder records which lines a sendQueue sends
+type sendRecorder struct {
+	sent chan string
+}
+
+func (r sendRecorder) lines(lines ...string) []func() {
+	sends := []func(){}
+	for _, line := range lines {
+		line := line
+		sends = append(sends, func() { r.sent <- line })
+	}
+	return sends
+}
+
+func TestSendQueue(t *testing.T) {
+	Convey("When lines are queued for IRC", t, func() {
+		clk := newFakeClock()
+		metrics := new(expvar.Map).Init()
+		q := newSendQueue(IRCConfig{FloodRate: 0.5, FloodBurst: 3, FloodGlobalRate: 1, FloodGlobalBurst: 5}, clk, metrics)
+		r := sendRecorder{sent: make(chan string, 100)}
+
+		take := func() ([]string, time.Duration) {
+			lines := []string{}
+			for {
+				line, wait := q.next(clk.Now())
+				if line == nil {
+					return lines, wait
+				}
+				line.send()
+				lines = append(lines, <-r.sent)
+			}
+		}
+
+		q.push("paster", "#foo", r.lines("p1", "p2", "p3", "p4", "p5"))
+
+		Convey("Each target gets a burst, then is rate limited", func() {
+			lines, wait := take()
+			So(lines, ShouldResemble, []string{"p1", "p2", "p3"})
+			So(wait, ShouldEqual, 2*time.Second)
+
+			clk.advance(2 * time.Second)
+			lines, wait = take()
+			So(lines, ShouldResemble, []string{"p4"})
+			So(wait, ShouldEqual, 2*time.Second)
+
+			So(metrics.Get("depth").String(), ShouldEqual, "1")
+			So(metrics.Get("sent").String(), ShouldEqual, "4")
+			So(metrics.Get("target_depth").(*expvar.Map).Get("#foo").String(), ShouldEqual, "1")
+		})
+
+		Convey("Other targets share the global limit", func() {
+			take()
+			q.push("talker", "#bar", r.lines("t1", "t2", "t3"))
+			lines, wait := take()
+			So(lines, ShouldResemble, []string{"t1", "t2"})
+			So(wait, ShouldEqual, time.Second)
+		})
+
+		Convey("Short messages jump ahead of long ones", func() {
+			take()
+			q.push("talker", "#foo", r.lines("t1"))
+			q.push("paster", "#foo", r.lines("p6"))
+
+			clk.advance(2 * time.Second)
+			lines, _ := take()
+			So(lines, ShouldResemble, []string{"t1"})
+
+			clk.advance(2 * time.Second)
+			lines, _ = take()
+			So(lines, ShouldResemble, []string{"p4"})
+		})
+
+		Convey("Pastes sent a line at a time don't jump ahead", func() {
+			take()
+			q.push("paster", "#foo", r.lines("p6"))
+			q.push("talker", "#foo", r.lines("t1"))
+
+			clk.advance(2 * time.Second)
+			lines, _ := take()
+			So(lines, ShouldResemble, []string{"t1"})
+		})
+
+		Convey("Lines sent straight away count against the global limit", func() {
+			q.takeGlobal()
+			q.takeGlobal()
+			q.takeGlobal()
+			lines, wait := take()
+			So(lines, ShouldResemble, []string{"p1", "p2"})
+			So(wait, ShouldEqual, time.Second)
+		})
+
+		Convey("Waiting lines can be dropped", func() {
+			take()
+			So(q.clear(), ShouldEqual, 2)
+			So(metrics.Get("depth").String(), ShouldEqual, "0")
+			So(metrics.Get("target_depth").(*expvar.Map).Get("#foo").String(), ShouldEqual, "0")
+
+			clk.advance(time.Minute)
+			q.push("talker", "#foo", r.lines("t1"))
+			lines, _ := take()
+			So(lines, ShouldResemble, []string{"t1"})
+		})
+
+		Convey("Targets are forgotten once back to a full burst with nothing waiting", func() {
+			q.push("someone", "someone", r.lines("reply"))
+			take()
+			So(q.targets, ShouldContainKey, "#foo")
+			So(q.targets, ShouldContainKey, "someone")
+
+			clk.advance(ircTargetSweepInterval)
+			take()
+			So(q.targets, ShouldContainKey, "#foo")
+			So(q.targets, ShouldNotContainKey, "someone")
+		})
+
+		Convey("Messages which would overfill the queue are dropped", func() {
+			q.push("paster", "#foo", make([]func(), ircMaxQueueDepth-5))
+			q.push("talker", "#bar", r.lines("t1"))
+			So(metrics.Get("depth").String(), ShouldEqual, fmt.Sprint(ircMaxQueueDepth))
+		})
+
+		Convey("The queue sends lines as the limits allow", func() {
+			quit := make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				q.run(quit)
+				close(stopped)
+			}()
+			defer func() {
+				close(quit)
+				<-stopped
+			}()
+
+			So([]string{receive(r.sent), receive(r.sent), receive(r.sent)}, ShouldResemble, []string{"p1", "p2", "p3"})
+			So(clk.waitForTimer(), ShouldBeTrue)
+			So(len(r.sent), ShouldEqual, 0)
+
+			clk.advance(2 * time.Second)
+			So(receive(r.sent), ShouldEqual, "p4")
+		})
+	})
+}
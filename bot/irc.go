@@ -2,9 +2,15 @@ package bot
 
 import (
 	"crypto/tls"
+	"expvar"
 	"fmt"
+	"net"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	irc "github.com/thoj/go-ircevent"
@@ -18,15 +24,105 @@ type IRCConfig struct {
 	User string `json:"user"`
 	Pass string `json:"pass"`
 
+	// AltNicks are tried in order if Nick is unavailable, while we keep trying to change back to Nick
+	AltNicks []string `json:"alt_nicks"`
+
+	// NickServPassword identifies us with NickServ, or whichever service NickServ names, once we have Nick
+	// It is also used to free Nick with GHOST, or REGAIN if NickServRegain is set, if someone else is using it
+	NickServ         string `json:"nickserv"`
+	NickServPassword string `json:"nickserv_password"`
+	NickServRegain   bool   `json:"nickserv_regain"`
+
 	SSL       bool   `json:"ssl"`
 	SSLVerify bool   `json:"ssl_verify"`
 	Server    string `json:"server"`
 
+	// TLSCert and TLSKey are PEM files holding a client certificate to present to the server, e.g. for CertFP
+	// TLSKey may be left empty if the key is in the same file as the certificate
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// SASLMech is "PLAIN" to log in to an account with SASLAccount and SASLPassword while connecting, or "EXTERNAL" to
+	// log in with the client certificate
+	SASLMech     string `json:"sasl_mech"`
+	SASLAccount  string `json:"sasl_account"`
+	SASLPassword string `json:"sasl_password"`
+
+	// CTCPVersion and CTCPSource are the replies to CTCP VERSION and SOURCE queries, if not the defaults
+	CTCPVersion string `json:"ctcp_version"`
+	CTCPSource  string `json:"ctcp_source"`
+
+	// FloodRate and FloodBurst limit the lines sent to each channel, to FloodRate a second after the first FloodBurst
+	// FloodGlobalRate and FloodGlobalBurst limit the lines sent to the server in the same way
+	FloodRate        float64 `json:"flood_rate"`
+	FloodBurst       int     `json:"flood_burst"`
+	FloodGlobalRate  float64 `json:"flood_global_rate"`
+	FloodGlobalBurst int     `json:"flood_global_burst"`
+
 	CommandChars string `json:"command_chars"`
 }
 
 var (
 	iSession *irc.Connection
+
+	// iQueue limits the rate of the messages we relay to IRC
+	iQueue *sendQueue
+
+	// ircSendQueueMetrics publishes the depth of iQueue and the number of lines it has sent, for expvar
+	ircSendQueueMetrics = expvar.NewMap("irc_send_queue")
+
+	// iPrefix holds our own "nick!user@host" as other users see it, once the server has told us what it is, or ""
+	iPrefix atomic.Value
+)
+
+const (
+	// ircMaxLineLength is the maximum length of an IRC line, including the trailing CRLF
+	ircMaxLineLength = 512
+
+	// ircMaxHostLength is the length assumed for our own hostname until we know what it is
+	ircMaxHostLength = 63
+)
+
+// redactedKey is logged in place of channel keys
+const redactedKey = "<redacted>"
+
+var (
+	iChannelKeys map[string]string
+
+	// iChanModes and iPrefixModes are the channel modes which always take a parameter, split as the server lists them
+	// iParamModes combines them, and iParamModesWhenSet lists the modes which only take a parameter when being set
+	iChanModes         = "beIk"
+	iPrefixModes       = "ohv"
+	iParamModes        = iChanModes + iPrefixModes
+	iParamModesWhenSet = "l"
+
+	// iTopicLength is the longest topic the server allows, from ISUPPORT TOPICLEN, or 0 if it hasn't said
+	iTopicLength int
+
+	// iChannelLock protects the channel keys, modes, status symbols and topic length, which change as the server tells
+	// us about them
+	iChannelLock sync.Mutex
+)
+
+const (
+	// ircReconnectMinDelay and ircReconnectMaxDelay bound how long we wait between attempts to reconnect to IRC
+	ircReconnectMinDelay = 5 * time.Second
+	ircReconnectMaxDelay = 5 * time.Minute
+)
+
+var (
+	iReconnectBackoff = newBackoff(ircReconnectMinDelay, ircReconnectMaxDelay)
+
+	// iConnected is 1 while we are registered with the IRC server
+	// iDropped is 1 from losing the connection until we are registered again
+	iConnected, iDropped int32
+
+	// iQuitting is closed to disconnect from IRC, and iStopped is closed once we have
+	iQuitting, iStopped chan struct{}
+
+	// iSessionLock is held to send to IRC through iSession from outside its callbacks, and held exclusively to
+	// connect or disconnect it, since go-ircevent closes the channel lines are sent through when disconnecting
+	iSessionLock sync.RWMutex
 )
 
 func iInit() {
@@ -34,43 +130,529 @@ func iInit() {
 	iSession = irc.IRC(c.Nick, c.User)
 
 	iSession.UseTLS = c.SSL
-	// InsecureSkipVerify may be required to communicate with IRC servers.
-	if !c.SSLVerify {
-		iSession.TLSConfig = &tls.Config{InsecureSkipVerify: true} // nolint: gosec
+	if c.SSL {
+		iSession.TLSConfig = iTLSConfig(c)
 	}
 	iSession.Password = c.Pass
+	iSetupSASL(c)
+	iSetupNick(iSession)
+	iSetupCTCP(iSession)
+
+	iSession.AddCallback("001", iSetupSession)
+	iSession.AddCallback("CAP", iCap)
 	iSession.AddCallback("PRIVMSG", iPrivmsg)
 	iSession.AddCallback("CTCP_ACTION", iAction)
+	iSession.AddCallback("NOTICE", iNotice)
+	iSession.AddCallback("JOIN", iJoin)
+	iSession.AddCallback("JOIN", iMemberJoin)
+	iSession.AddCallback("PART", iMemberPart)
+	iSession.AddCallback("KICK", iMemberKick)
+	iSession.AddCallback("QUIT", iMemberQuit)
+	iSession.AddCallback("NICK", iMemberNick)
+	iSession.AddCallback("353", iNames)
+	iSession.AddCallback("332", iTopicOnJoin)
+	iSession.AddCallback("TOPIC", iTopic)
+	iSession.AddCallback("482", iNotChanOp)
+	iSession.AddCallback("REDACT", iRedact)
+	iSession.AddCallback("MODE", iMode)
+	iSession.AddCallback("005", iISupport)
+	iSession.AddCallback("475", iBadChannelKey)
+
+	iQuitting, iStopped = make(chan struct{}), make(chan struct{})
+	iQueue = newSendQueue(c, realClock{}, ircSendQueueMetrics)
+	running := sync.WaitGroup{}
+	running.Add(3)
+	go func() {
+		defer running.Done()
+		iMaintainConnection(iSession, iQuitting)
+	}()
+	go func() {
+		defer running.Done()
+		iReclaimNick(iQuitting)
+	}()
+	go func() {
+		defer running.Done()
+		iQueue.run(iQuitting)
+	}()
+	go func() {
+		running.Wait()
+		close(iStopped)
+	}()
+}
+
+// iTLSConfig returns the TLS settings for connecting to IRC, including any client certificate
+func iTLSConfig(c IRCConfig) *tls.Config {
+	host, _, _ := net.SplitHostPort(c.Server)
+
+	// InsecureSkipVerify may be required to communicate with IRC servers.
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: !c.SSLVerify} // nolint: gosec
+
+	if c.TLSCert != "" {
+		keyFile := c.TLSKey
+		if keyFile == "" {
+			keyFile = c.TLSCert
+		}
 
-	err := iSession.Connect(c.Server)
-	if err != nil {
-		log.Fatalf("Failed to initialise IRC session: %s", err)
+		cert, err := tls.LoadX509KeyPair(c.TLSCert, keyFile)
+		if err != nil {
+			log.Fatalf("Failed to load IRC client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
 
-	iSession.AddCallback("001", iSetupSession)
+	return config
+}
+
+// iSetupSASL checks the SASL settings and has go-ircevent authenticate with them while connecting
+func iSetupSASL(c IRCConfig) {
+	mech := strings.ToUpper(c.SASLMech)
+	switch mech {
+	case "":
+		return
+	case "PLAIN":
+		if c.SASLAccount == "" || c.SASLPassword == "" {
+			log.Fatalf("SASL PLAIN needs both sasl_account and sasl_password to be set")
+		}
+	case "EXTERNAL":
+		if !c.SSL || c.TLSCert == "" {
+			log.Fatalf("SASL EXTERNAL needs ssl to be enabled and a tls_cert to be set")
+		}
+	default:
+		log.Fatalf("Unsupported SASL mechanism %q; use PLAIN or EXTERNAL", c.SASLMech)
+	}
 
-	go iHandleErrors()
+	iSession.UseSASL = true
+	iSession.SASLMech = mech
+	iSession.SASLLogin = c.SASLAccount
+	iSession.SASLPassword = c.SASLPassword
+
+	// go-ircevent only handles 904 for a failed login, and would wait for the others until it timed out
+	for _, code := range []string{"905", "906"} {
+		iSession.AddCallback(code, iSASLFailed)
+	}
+}
+
+// iSASLFailed handles the server failing our SASL login, because the login was too long (905) or aborted (906), as
+// go-ircevent does a bad login (904), which makes it end the connection straight away
+func iSASLFailed(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	failed := *e
+	failed.Code = "904"
+	iSession.RunCallbacks(&failed)
+}
 
-	log.Infof("Connected to IRC")
+// iSASLRefused returns whether `err`, from connecting `session` to IRC, means the server refused our SASL login
+// go-ircevent only fails after connecting if SASL fails, but when it times out waiting for the server, that could be
+// the connection's fault rather than the server's
+func iSASLRefused(session *irc.Connection, err error) bool {
+	return session.UseSASL && session.Connected() && !strings.Contains(err.Error(), "timed out")
 }
 
-func iHandleErrors() {
-	for err := range iSession.ErrorChan() {
-		log.Errorf("IRC error: %s", err) // TODO
+// iMaintainConnection connects `session` to IRC and keeps it connected, reconnecting whenever the connection drops
+// Failed attempts are retried after a backoff, and mapped Discord channels are told when the connection drops
+// It disconnects and returns once `quit` is closed
+func iMaintainConnection(session *irc.Connection, quit <-chan struct{}) {
+	iResetSession()
+	err := iConnect(func() error { return session.Connect(conf.IRC.Server) })
+	for {
+		if err != nil {
+			if iSASLRefused(session, err) {
+				log.Fatalf("Failed to authenticate with IRC using SASL %s: %s", session.SASLMech, err)
+				return
+			}
+
+			if session.Connected() {
+				iDisconnect(session)
+			}
+
+			delay := iReconnectBackoff.next()
+			log.Errorf("Failed to connect to IRC, retrying in %s: %s", delay, err)
+			select {
+			case <-time.After(delay):
+			case <-quit:
+				return
+			}
+
+			iResetSession()
+			err = iConnect(session.Reconnect)
+			continue
+		}
+
+		log.Infof("Connected to IRC")
+
+		select {
+		case err = <-session.ErrorChan():
+		case <-quit:
+			atomic.StoreInt32(&iConnected, 0)
+			iDisconnect(session)
+			return
+		}
+		log.Errorf("Lost connection to IRC: %s", err)
+
+		atomic.StoreInt32(&iConnected, 0)
+		if dropped := iQueue.clear(); dropped > 0 {
+			log.Errorf("Dropped %d lines waiting to be sent to IRC", dropped)
+		}
+		if atomic.SwapInt32(&iDropped, 1) == 0 {
+			ircStatusNotice("Lost connection to IRC; reconnecting")
+		}
 	}
 }
 
+// iResetSession forgets what we knew about the previous connection to IRC, before connecting again
+func iResetSession() {
+	iResetNick()
+	iPrefix.Store("")
+	iCaps.stop()
+	iMembers.forget("")
+
+	iChannelLock.Lock()
+	iTopicLength = 0
+	iChannelLock.Unlock()
+}
+
+// iQuit disconnects from IRC and stops reconnecting
+func iQuit() {
+	close(iQuitting)
+	<-iStopped
+}
+
 func iSetupSession(e *irc.Event) {
-	for c := range conf.Mapping {
-		iSession.Join(c)
+	iNickRegistered(e.Arguments[0])
+	iSession.SendRaw(iCaps.start())
+
+	for c := range modifiedMapping {
+		iJoinChannel(c)
+	}
+
+	iReconnectBackoff.reset()
+	atomic.StoreInt32(&iConnected, 1)
+	if atomic.SwapInt32(&iDropped, 0) == 1 {
+		log.Infof("Reconnected to IRC")
+		ircStatusNotice("Reconnected to IRC")
+	}
+}
+
+// iConnect runs `connect`, which connects iSession to IRC, once nothing is sending through it
+func iConnect(connect func() error) error {
+	iSessionLock.Lock()
+	defer iSessionLock.Unlock()
+
+	return connect()
+}
+
+// iDisconnect disconnects `session` from IRC, once nothing is sending through it
+func iDisconnect(session *irc.Connection) {
+	iSessionLock.Lock()
+	defer iSessionLock.Unlock()
+
+	session.Disconnect()
+}
+
+// iSend runs `send`, which sends something to IRC, if we are connected, returning whether it did
+// The connection can't be closed while `send` runs, so it must not be called from the connection's callbacks, which
+// closing the connection waits for
+func iSend(send func()) bool {
+	iSessionLock.RLock()
+	defer iSessionLock.RUnlock()
+
+	if atomic.LoadInt32(&iConnected) == 0 {
+		return false
+	}
+	send()
+	return true
+}
+
+// iSetChannelKeys replaces the keys used to join IRC channels, keyed by lowercased channel name
+func iSetChannelKeys(keys map[string]string) {
+	iChannelLock.Lock()
+	defer iChannelLock.Unlock()
+
+	iChannelKeys = keys
+}
+
+// iChannelKey returns the key used to join an IRC channel, or "" if it has none
+func iChannelKey(channel string) string {
+	iChannelLock.Lock()
+	defer iChannelLock.Unlock()
+
+	return iChannelKeys[strings.ToLower(channel)]
+}
+
+// iJoinChannel joins an IRC channel, with its key if it has one
+// Keys are never logged, since anyone who can read the logs could then join the channel
+func iJoinChannel(channel string) {
+	if key := iChannelKey(channel); key != "" {
+		log.Infof("Joining %s with key %s", channel, redactedKey)
+		iSession.Join(channel + " " + key)
+		return
+	}
+
+	log.Infof("Joining %s", channel)
+	iSession.Join(channel)
+}
+
+// iMode tracks changes to the keys of mapped channels, so that we can rejoin them after reconnecting, and to the status
+// of their members
+func iMode(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+
+	channel := strings.ToLower(e.Arguments[0])
+	if _, ok := modifiedMapping[channel]; !ok {
+		return
+	}
+
+	iChannelLock.Lock()
+	prefixModes, prefixSymbols := iPrefixModes, iPrefixSymbols
+	iChannelLock.Unlock()
+
+	for _, change := range iParseModes(e.Arguments[1], e.Arguments[2:]) {
+		if i := strings.IndexByte(prefixModes, change.mode); i != -1 && i < len(prefixSymbols) {
+			iMembers.changeStatus(channel, change.param, prefixSymbols[i], change.set)
+			continue
+		}
+		if change.mode != 'k' {
+			continue
+		}
+
+		iChannelLock.Lock()
+		if change.set && change.param != "" {
+			log.Infof("%s changed the key for %s to %s", e.Nick, channel, redactedKey)
+			iChannelKeys[channel] = change.param
+		} else if !change.set {
+			log.Infof("%s removed the key for %s", e.Nick, channel)
+			delete(iChannelKeys, channel)
+		}
+		iChannelLock.Unlock()
+	}
+}
+
+// ircModeChange is a single mode being set or unset by a MODE message
+type ircModeChange struct {
+	set   bool
+	mode  byte
+	param string
+}
+
+// iParseModes splits a channel mode string such as "+kl-o key 10 nick" into the changes it makes
+// Which modes take parameters varies between servers, so this follows what the server told us in RPL_ISUPPORT
+func iParseModes(modes string, params []string) []ircModeChange {
+	iChannelLock.Lock()
+	always, whenSet := iParamModes, iParamModesWhenSet
+	iChannelLock.Unlock()
+
+	changes := []ircModeChange{}
+	set := true
+	for i := 0; i < len(modes); i++ {
+		switch c := modes[i]; c {
+		case '+', '-':
+			set = c == '+'
+		default:
+			change := ircModeChange{set: set, mode: c}
+			if len(params) != 0 && (strings.IndexByte(always, c) != -1 || (set && strings.IndexByte(whenSet, c) != -1)) {
+				change.param = params[0]
+				params = params[1:]
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// iISupport records which channel modes take parameters, and the symbols for channel status in NAMES, from the
+// server's RPL_ISUPPORT
+// e.g. "CHANMODES=beI,k,l,imnpst" and "PREFIX=(ov)@+"
+func iISupport(e *irc.Event) {
+	iChannelLock.Lock()
+	defer iChannelLock.Unlock()
+
+	for _, token := range e.Arguments {
+		switch {
+		case strings.HasPrefix(token, "CHANMODES="):
+			types := strings.Split(strings.TrimPrefix(token, "CHANMODES="), ",")
+			if len(types) >= 3 {
+				iChanModes = types[0] + types[1]
+				iParamModesWhenSet = types[2]
+			}
+		case strings.HasPrefix(token, "PREFIX=("):
+			if end := strings.IndexByte(token, ')'); end != -1 {
+				iPrefixModes = token[len("PREFIX=("):end]
+				iPrefixSymbols = token[end+1:]
+			}
+		case strings.HasPrefix(token, "TOPICLEN="):
+			if length, err := strconv.Atoi(strings.TrimPrefix(token, "TOPICLEN=")); err == nil {
+				iTopicLength = length
+			}
+		}
+	}
+	iParamModes = iChanModes + iPrefixModes
+}
+
+// iBadChannelKey reports failing to join a mapped channel because its key is wrong or missing
+func iBadChannelKey(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	log.Errorf("Failed to join %s: the channel key is wrong or missing", e.Arguments[1])
+}
+
+// iTopicOnJoin follows the topic of a channel as the server tells us on joining it
+// e.g. "332 bridge #foo :the topic"
+func iTopicOnJoin(e *irc.Event) {
+	if len(e.Arguments) < 3 {
+		return
+	}
+	incomingIRCTopic(strings.ToLower(e.Arguments[1]), "", e.Arguments[2])
+}
+
+// iTopic follows changes to the topic of a channel, except our own, which came from Discord
+func iTopic(e *irc.Event) {
+	if len(e.Arguments) < 1 || iOwnMessage(e) {
+		return
+	}
+	incomingIRCTopic(strings.ToLower(e.Arguments[0]), e.Nick, e.Message())
+}
+
+// iSetTopic sets the topic of an IRC channel, shortened to what the server allows rather than letting it cut it short
+func iSetTopic(channel, topic string) {
+	// ":nick!user@host TOPIC #channel :topic\r\n"
+	length := ircMaxLineLength - len(fmt.Sprintf(":%s TOPIC %s :\r\n", iOwnPrefix(), channel))
+	iChannelLock.Lock()
+	if iTopicLength > 0 && iTopicLength < length {
+		length = iTopicLength
+	}
+	iChannelLock.Unlock()
+	topic = truncateTopic(topic, length)
+
+	if !iQueueLines("", channel, []string{fmt.Sprintf("TOPIC %s :%s", channel, topic)}) {
+		log.Errorf("Not connected to IRC; failed to set the topic of %s", channel)
 	}
 }
 
+// iNotChanOp reports failing to do something in a channel which needs channel operator status, such as setting the topic
+func iNotChanOp(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	log.Errorf("Failed to change %s: %s", e.Arguments[1], e.Message())
+}
+
+func iJoin(e *irc.Event) {
+	if strings.EqualFold(e.Nick, iCurrentNick()) {
+		iPrefix.Store(e.Source)
+	}
+}
+
+// iRenamePrefix follows our own nick changing to `nick` in our "nick!user@host", if we know it yet
+func iRenamePrefix(nick string) {
+	prefix, _ := iPrefix.Load().(string)
+	if i := strings.Index(prefix, "!"); i >= 0 {
+		iPrefix.Store(nick + prefix[i:])
+	}
+}
+
+// iOwnMessage returns whether an event is an echo of something we sent, which servers with echo-message send back
+func iOwnMessage(e *irc.Event) bool {
+	return strings.EqualFold(e.Nick, iCurrentNick())
+}
+
 func iPrivmsg(e *irc.Event) {
-	incomingIRC(e.Nick, strings.ToLower(e.Arguments[0]), e.Message())
+	if iOwnMessage(e) {
+		iRememberMsgID(e, "PRIVMSG", e.Message())
+		return
+	}
+	if iDeleteCommand(e) {
+		return
+	}
+	incomingIRC(e.Nick, strings.ToLower(e.Arguments[0]), e.Message(), e.Tags["msgid"])
 }
 func iAction(e *irc.Event) {
-	incomingIRC(e.Nick, strings.ToLower(e.Arguments[0]), fmt.Sprintf("\x1d%s\x1d", e.Message()))
+	if iOwnMessage(e) {
+		iRememberMsgID(e, "PRIVMSG", "\x01ACTION "+e.Message()+"\x01")
+		return
+	}
+	incomingIRC(e.Nick, strings.ToLower(e.Arguments[0]), fmt.Sprintf("\x1d%s\x1d", e.Message()), e.Tags["msgid"])
+}
+
+const (
+	// ircDefaultCTCPVersion and ircDefaultCTCPSource are the replies to CTCP VERSION and SOURCE unless configured
+	ircDefaultCTCPVersion = "DisGoIRC - https://github.com/GinjaNinja32/DisGoIRC"
+	ircDefaultCTCPSource  = "https://github.com/GinjaNinja32/DisGoIRC"
+
+	// ircCTCPClientInfo lists the CTCP queries we understand, for CTCP CLIENTINFO
+	ircCTCPClientInfo = "ACTION CLIENTINFO PING SOURCE TIME VERSION"
+)
+
+// iSetupCTCP replaces go-ircevent's replies to CTCP queries with ours
+// go-ircevent gives queries it knows their own event codes, and the rest the code "CTCP"
+func iSetupCTCP(session *irc.Connection) {
+	for _, code := range []string{"CTCP_VERSION", "CTCP_TIME", "CTCP_PING", "CTCP_USERINFO", "CTCP_CLIENTINFO"} {
+		session.ClearCallback(code)
+		session.AddCallback(code, iCTCP)
+	}
+	session.AddCallback("CTCP", iCTCP)
+}
+
+// iCTCP answers a CTCP query, e.g. "\x01VERSION\x01", with a NOTICE to whoever sent it
+func iCTCP(e *irc.Event) {
+	if iOwnMessage(e) || e.Nick == "" {
+		return
+	}
+
+	query := strings.SplitN(e.Message(), " ", 2)
+	args := ""
+	if len(query) == 2 {
+		args = query[1]
+	}
+
+	reply, ok := iCTCPReply(query[0], args, time.Now())
+	if !ok {
+		log.Debugf("Ignoring CTCP %s from %s", query[0], e.Nick)
+		return
+	}
+
+	log.Infof("Answering CTCP %s from %s", query[0], e.Nick)
+	iQueueLines("", e.Nick, []string{fmt.Sprintf("NOTICE %s :\x01%s\x01", e.Nick, reply)})
+}
+
+// iCTCPReply returns the reply to the CTCP query `command` with `args`, or false if we don't answer it
+func iCTCPReply(command, args string, now time.Time) (string, bool) {
+	switch command = strings.ToUpper(command); command {
+	case "VERSION":
+		return command + " " + configuredOr(conf.IRC.CTCPVersion, ircDefaultCTCPVersion), true
+	case "SOURCE":
+		return command + " " + configuredOr(conf.IRC.CTCPSource, ircDefaultCTCPSource), true
+	case "TIME":
+		return command + " " + now.Format(time.RFC1123Z), true
+	case "PING":
+		return strings.TrimSpace(command + " " + args), true
+	case "CLIENTINFO":
+		return command + " " + ircCTCPClientInfo, true
+	}
+	return "", false
+}
+
+func configuredOr(value, otherwise string) string {
+	if value != "" {
+		return value
+	}
+	return otherwise
+}
+
+// iNotice relays channel NOTICEs; NOTICEs to us, from the server or services, and CTCP replies are not relayed
+func iNotice(e *irc.Event) {
+	if len(e.Arguments) < 2 || e.Nick == "" || strings.HasPrefix(e.Message(), "\x01") {
+		return
+	}
+	if iOwnMessage(e) {
+		iRememberMsgID(e, "NOTICE", e.Message())
+		return
+	}
+	incomingIRCNotice(e.Nick, strings.ToLower(e.Arguments[0]), e.Message())
 }
 
 var outgoingNickRegex = regexp.MustCompile(`\b[a-zA-Z0-9]`)
@@ -80,14 +662,103 @@ func iAddAntiPing(s string) string {
 	return outgoingNickRegex.ReplaceAllString(s, "$0\ufeff")
 }
 
+// iActionLines renders a CTCP ACTION prefixed with the provided nick, as the IRC equivalent of a Discord /me, split
+// into PRIVMSG lines
+func iActionLines(nick, channel string, message format.FormattedString) []string {
+	prefix := fmt.Sprintf("\x01ACTION \x02%s\x02 ", iAddAntiPing(nick))
+	return iSplitLines("PRIVMSG", channel, prefix, "\x01", message)
+}
+
 // iOutgoing transmits an IRC message prefixed with the provided nick if not set to anonymous
 func iOutgoing(nick, channel string, message format.FormattedString, anonymous bool) {
-	outgoingMessage := ""
-	if anonymous {
-		outgoingMessage = message.RenderIRC()
-	} else {
-		nick = iAddAntiPing(nick)
-		outgoingMessage = fmt.Sprintf("<%s> %s", nick, message.RenderIRC())
-	}
-	iSession.Privmsg(channel, outgoingMessage)
+	iOutgoingCommand("PRIVMSG", nick, channel, message, anonymous)
+}
+
+// iOutgoingCommand transmits an IRC message with `command`, PRIVMSG or NOTICE, prefixed with the provided nick if not
+// set to anonymous
+func iOutgoingCommand(command, nick, channel string, message format.FormattedString, anonymous bool) {
+	iSendLines(command, nick, channel, iSplitMessage(command, nick, channel, message, anonymous))
+}
+
+// iSendLines queues lines from the provided nick to an IRC channel with `command`, to be sent as flood control allows
+// Lines are dropped if we are not connected, if the queue is full, or if the connection drops before they are sent
+func iSendLines(command, nick, channel string, lines []string) {
+	iSendTaggedLines("", command, nick, channel, lines)
+}
+
+// iSendTaggedLines is iSendLines with IRCv3 client tags, e.g. "+draft/edit=msgid", sent on each line
+func iSendTaggedLines(tags, command, nick, channel string, lines []string) {
+	if tags != "" {
+		command = "@" + tags + " " + command
+	}
+
+	raw := []string{}
+	for _, line := range lines {
+		raw = append(raw, fmt.Sprintf("%s %s :%s", command, channel, line))
+	}
+	if !iQueueLines(nick, channel, raw) {
+		log.Errorf("Not connected to IRC; dropped %d lines to %s from %s", len(lines), channel, nick)
+	}
+}
+
+// iQueueLines queues raw lines to `target` from `sender`, or "" for lines of our own such as replies to CTCP queries,
+// to be sent as flood control allows, returning false if we are not connected
+// The lines aren't logged, since they may hold passwords
+func iQueueLines(sender, target string, lines []string) bool {
+	if atomic.LoadInt32(&iConnected) == 0 {
+		return false
+	}
+
+	sends := []func(){}
+	for _, line := range lines {
+		line := line
+		sends = append(sends, func() {
+			sent := iSend(func() {
+				iSession.SendRaw(line)
+			})
+			if !sent {
+				log.Errorf("Not connected to IRC; dropped a line to %s", target)
+			}
+		})
+	}
+	iQueue.push(sender, target, sends)
+	return true
+}
+
+// iSplitMessage renders an IRC message prefixed with the provided nick if not set to anonymous, split into as many
+// lines as needed to fit within the IRC line length limit once the server adds our own prefix and `command`
+func iSplitMessage(command, nick, channel string, message format.FormattedString, anonymous bool) []string {
+	prefix := ""
+	if !anonymous {
+		prefix = fmt.Sprintf("<%s> ", iAddAntiPing(nick))
+	}
+	return iSplitLines(command, channel, prefix, "", message)
+}
+
+// iSplitLines renders an IRC message split into as many lines as needed to fit within the IRC line length limit, each
+// one between `prefix` and `suffix`
+func iSplitLines(command, channel, prefix, suffix string, message format.FormattedString) []string {
+	// ":nick!user@host PRIVMSG #channel :<nick> message\r\n"
+	budget := ircMaxLineLength - len(fmt.Sprintf(":%s %s %s :%s%s\r\n", iOwnPrefix(), command, channel, prefix, suffix))
+
+	lines := []string{}
+	for _, line := range message.SplitIRC(budget) {
+		lines = append(lines, prefix+line.RenderIRC()+suffix)
+	}
+	if len(lines) == 0 {
+		lines = append(lines, prefix+suffix)
+	}
+	return lines
+}
+
+// iOwnPrefix returns our own "nick!user@host" as other users see it, or the longest it could be if we don't know yet
+func iOwnPrefix() string {
+	if prefix, _ := iPrefix.Load().(string); prefix != "" {
+		return prefix
+	}
+	nick := iCurrentNick()
+	if len(nick) < len(conf.IRC.Nick) {
+		nick = conf.IRC.Nick
+	}
+	return fmt.Sprintf("%s!~%s@%s", nick, conf.IRC.User, strings.Repeat("x", ircMaxHostLength))
 }
@@ -0,0 +1,948 @@
+package bot
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	. "github.com/smartystreets/goconvey/convey"
+	irc "github.com/thoj/go-ircevent"
+
+	"github.com/GinjaNinja32/DisGoIRC/format"
+)
+
+// fakeIRCTimeout is how long the fake IRC server waits for the bridge to do anything
+const fakeIRCTimeout = 5 * time.Second
+
+// fakeIRCServer is a local IRC server, which hands each connection to the test to script
+type fakeIRCServer struct {
+	listener net.Listener
+	conns    chan *fakeIRCConn
+
+	lock     sync.Mutex
+	accepted []net.Conn
+}
+
+type fakeIRCConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newFakeIRCServer() *fakeIRCServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+
+	s := &fakeIRCServer{listener: listener, conns: make(chan *fakeIRCConn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.accepted = append(s.accepted, conn)
+			s.lock.Unlock()
+
+			s.conns <- &fakeIRCConn{conn: conn, reader: bufio.NewReader(conn)}
+		}
+	}()
+	return s
+}
+
+func (s *fakeIRCServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// close stops the server, closing every connection to it
+func (s *fakeIRCServer) close() {
+	s.listener.Close() // nolint: errcheck
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.accepted {
+		conn.Close() // nolint: errcheck
+	}
+}
+
+// accept returns the next connection from the bridge, or nil if it doesn't connect in time
+func (s *fakeIRCServer) accept() *fakeIRCConn {
+	select {
+	case c := <-s.conns:
+		return c
+	case <-time.After(fakeIRCTimeout):
+		return nil
+	}
+}
+
+// expect reads lines from the bridge until one starts with `prefix`, returning it, or "" if none arrives in time
+func (c *fakeIRCConn) expect(prefix string) string {
+	c.conn.SetReadDeadline(time.Now().Add(fakeIRCTimeout)) // nolint: errcheck
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return ""
+		}
+		if line = strings.TrimRight(line, "\r\n"); strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func (c *fakeIRCConn) send(line string) {
+	c.conn.Write([]byte(line + "\r\n")) // nolint: errcheck
+}
+
+// register completes registration of the bridge, returning the channels it then joins
+func (c *fakeIRCConn) register(joins int) []string {
+	nick := strings.TrimPrefix(c.expect("NICK "), "NICK ")
+	c.expect("USER ")
+	c.send(":fake.server 001 " + nick + " :Welcome")
+
+	lines := []string{}
+	for i := 0; i < joins; i++ {
+		lines = append(lines, c.expect("JOIN "))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// startFakeIRC points the bridge at `server` and connects, collecting any status notices it would post to Discord
+func startFakeIRC(server *fakeIRCServer, mapping map[string]string) (notices chan string, stop func()) {
+	return startFakeIRCWith(server, Config{Mapping: mapping})
+}
+
+// startFakeIRCWith is startFakeIRC with more of the config given, and the IRC server filled in
+func startFakeIRCWith(server *fakeIRCServer, c Config) (notices chan string, stop func()) {
+	notices = make(chan string, 10)
+	ircStatusNotice = func(message string) { notices <- message }
+	iReconnectBackoff = newBackoff(10*time.Millisecond, 50*time.Millisecond)
+
+	conf = c
+	conf.IRC.Server = server.addr()
+	if conf.IRC.Nick == "" {
+		conf.IRC.Nick, conf.IRC.User = "bridge", "bridge"
+	}
+	initMappings()
+	iInit()
+
+	return notices, func() {
+		server.close()
+		iQuit()
+	}
+}
+
+func receive(c chan string) string {
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(fakeIRCTimeout):
+		return ""
+	}
+}
+
+func TestIRCReconnect(t *testing.T) {
+	Convey("When the IRC connection drops mid-session", t, func() {
+		server := newFakeIRCServer()
+		notices, stop := startFakeIRC(server, map[string]string{
+			"#foo":        "guild#foo",
+			"#bar barkey": "guild#bar",
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		So(conn.register(2), ShouldResemble, []string{"JOIN #bar barkey", "JOIN #foo"})
+
+		iOutgoing("someone", "#foo", format.FormattedString{{Text: "hello"}}, true)
+		So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :hello")
+
+		conn.conn.Close() // nolint: errcheck
+		So(receive(notices), ShouldEqual, "Lost connection to IRC; reconnecting")
+
+		Convey("Messages are dropped until it reconnects", func() {
+			iOutgoing("someone", "#foo", format.FormattedString{{Text: "lost"}}, true)
+
+			conn = server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.register(2), ShouldResemble, []string{"JOIN #bar barkey", "JOIN #foo"})
+			So(receive(notices), ShouldEqual, "Reconnected to IRC")
+
+			iOutgoing("someone", "#foo", format.FormattedString{{Text: "found"}}, true)
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :found")
+		})
+
+		Convey("It keeps retrying while the server is unavailable", func() {
+			refused := server.accept()
+			So(refused, ShouldNotBeNil)
+			refused.conn.Close() // nolint: errcheck
+
+			conn = server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.register(2), ShouldResemble, []string{"JOIN #bar barkey", "JOIN #foo"})
+			So(receive(notices), ShouldEqual, "Reconnected to IRC")
+		})
+	})
+}
+
+func TestIRCChannelKeys(t *testing.T) {
+	Convey("When mapped channels have keys", t, func() {
+		hook := logtest.NewGlobal()
+		defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Mapping: map[string]string{
+				"#foo":           "guild#foo",
+				"#bar legacykey": "guild#bar",
+				"#baz":           "guild#baz",
+			},
+			Channels: map[string]ChannelConfig{
+				"#foo": {Key: "fookey"},
+			},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		So(conn.register(3), ShouldResemble, []string{"JOIN #bar legacykey", "JOIN #baz", "JOIN #foo fookey"})
+
+		Convey("Key changes are used when rejoining", func() {
+			conn.send(":op!op@host MODE #foo +o-k someone *")
+			conn.send(":op!op@host MODE #baz +lk 10 newkey")
+			conn.send(":op!op@host MODE #bar +b-k *!*@spam legacykey")
+			conn.send(":op!op@host MODE #bar +k barkey")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+			conn.conn.Close() // nolint: errcheck
+
+			conn = server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.register(3), ShouldResemble, []string{"JOIN #bar barkey", "JOIN #baz newkey", "JOIN #foo"})
+		})
+
+		Convey("Keys are never logged", func() {
+			conn.send(":op!op@host MODE #foo +k secretkey")
+			conn.send(":fake.server 475 bridge #foo :Cannot join channel (+k)")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+
+			logs := ""
+			for _, entry := range hook.AllEntries() {
+				logs += entry.Message + "\n"
+			}
+			So(logs, ShouldContainSubstring, "#foo")
+			So(logs, ShouldNotContainSubstring, "fookey")
+			So(logs, ShouldNotContainSubstring, "legacykey")
+			So(logs, ShouldNotContainSubstring, "secretkey")
+		})
+	})
+}
+
+func TestIRCParseModes(t *testing.T) {
+	Convey("When iParseModes is used", t, func() {
+		So(iParseModes("+kl-o", []string{"key", "10", "nick"}), ShouldResemble, []ircModeChange{
+			{true, 'k', "key"}, {true, 'l', "10"}, {false, 'o', "nick"},
+		})
+		So(iParseModes("-lk+m", []string{"*"}), ShouldResemble, []ircModeChange{
+			{false, 'l', ""}, {false, 'k', "*"}, {true, 'm', ""},
+		})
+		So(iParseModes("+bk", []string{"*!*@host"}), ShouldResemble, []ircModeChange{
+			{true, 'b', "*!*@host"}, {true, 'k', ""},
+		})
+	})
+}
+
+func TestIRCSASL(t *testing.T) {
+	Convey("When SASL PLAIN is configured", t, func() {
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			IRC: IRCConfig{
+				Nick: "bridge", User: "bridge",
+				SASLMech: "plain", SASLAccount: "account", SASLPassword: "password",
+			},
+			Mapping: map[string]string{"#foo": "guild#foo"},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		So(conn.expect("CAP "), ShouldEqual, "CAP LS")
+		conn.send(":fake.server CAP * LS :multi-prefix sasl")
+		So(conn.expect("CAP "), ShouldEqual, "CAP REQ :sasl")
+		conn.send(":fake.server CAP * ACK :sasl")
+		So(conn.expect("AUTHENTICATE "), ShouldEqual, "AUTHENTICATE PLAIN")
+		conn.send("AUTHENTICATE +")
+
+		credentials := base64.StdEncoding.EncodeToString([]byte("account\x00account\x00password"))
+		So(conn.expect("AUTHENTICATE "), ShouldEqual, "AUTHENTICATE "+credentials)
+
+		Convey("It registers once authenticated", func() {
+			conn.send(":fake.server 903 * :SASL authentication successful")
+			So(conn.expect("CAP "), ShouldEqual, "CAP END")
+			So(conn.register(1), ShouldResemble, []string{"JOIN #foo"})
+		})
+
+		Convey("It stops with a fatal error if authentication fails", func() {
+			hook := logtest.NewGlobal()
+			defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+
+			exited := make(chan string, 1)
+			log.StandardLogger().ExitFunc = func(int) { exited <- hook.LastEntry().Message }
+			defer func() { log.StandardLogger().ExitFunc = nil }()
+
+			conn.send(":fake.server 904 bridge :SASL authentication failed")
+			So(receive(exited), ShouldEqual, "Failed to authenticate with IRC using SASL PLAIN: SASL authentication failed")
+		})
+
+		Convey("It stops with a fatal error straight away if authentication is aborted", func() {
+			hook := logtest.NewGlobal()
+			defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+
+			exited := make(chan string, 1)
+			log.StandardLogger().ExitFunc = func(int) { exited <- hook.LastEntry().Message }
+			defer func() { log.StandardLogger().ExitFunc = nil }()
+
+			conn.send(":fake.server 906 bridge :SASL authentication aborted")
+			So(conn.expect("CAP "), ShouldEqual, "CAP END")
+			So(receive(exited), ShouldEqual, "Failed to authenticate with IRC using SASL PLAIN: SASL authentication aborted")
+		})
+	})
+}
+
+func TestIRCNick(t *testing.T) {
+	Convey("When the bridge has alternate nicks and a NickServ password", t, func() {
+		hook := logtest.NewGlobal()
+		defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+
+		interval := ircNickReclaimInterval
+		ircNickReclaimInterval = 50 * time.Millisecond
+		defer func() { ircNickReclaimInterval = interval }()
+
+		c := Config{
+			IRC: IRCConfig{
+				Nick: "bridge", User: "bridge", AltNicks: []string{"bridge2", "bridge3"},
+				NickServPassword: "password",
+			},
+			Mapping: map[string]string{"#foo": "guild#foo"},
+		}
+		server := newFakeIRCServer()
+
+		Convey("It identifies once registered with its configured nick", func() {
+			c.IRC.NickServ = "AuthServ"
+			_, stop := startFakeIRCWith(server, c)
+			defer stop()
+
+			conn := server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+			conn.send(":fake.server 001 bridge :Welcome")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG AuthServ :IDENTIFY bridge password")
+		})
+
+		Convey("It tries its alternate nicks, then underscores, while the server refuses them", func() {
+			_, stop := startFakeIRCWith(server, c)
+			defer stop()
+
+			conn := server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+			conn.send(":fake.server 433 * bridge :Nickname is already in use")
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge2")
+			conn.send(":fake.server 436 * bridge2 :Nickname collision KILL")
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge3")
+			conn.send(":fake.server 437 * bridge3 :Nick/channel is temporarily unavailable")
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge3_")
+			conn.send(":fake.server 433 * bridge3_ :Nickname is already in use")
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge3__")
+			conn.send(":fake.server 001 bridge3__ :Welcome")
+
+			Convey("Then ghosts its configured nick and keeps trying to reclaim it", func() {
+				So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG NickServ :GHOST bridge password")
+				So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+				conn.send(":fake.server 433 bridge3__ bridge :Nickname is already in use")
+				So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+
+				conn.send(":bridge3__!bridge@host NICK :bridge")
+				So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG NickServ :IDENTIFY bridge password")
+				So(iCurrentNick(), ShouldEqual, "bridge")
+			})
+
+			Convey("And the password is never logged", func() {
+				conn.expect("NICK bridge")
+				conn.send(":bridge3__!bridge@host NICK :bridge")
+				conn.expect("PRIVMSG NickServ :IDENTIFY")
+
+				logs := ""
+				for _, entry := range hook.AllEntries() {
+					logs += entry.Message + "\n"
+				}
+				So(logs, ShouldContainSubstring, "bridge3__")
+				So(logs, ShouldNotContainSubstring, "password")
+			})
+		})
+
+		Convey("It uses REGAIN instead of GHOST if configured to", func() {
+			c.IRC.NickServRegain = true
+			_, stop := startFakeIRCWith(server, c)
+			defer stop()
+
+			conn := server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+			conn.send(":fake.server 433 * bridge :Nickname is already in use")
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge2")
+			conn.send(":fake.server 001 bridge2 :Welcome")
+
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG NickServ :REGAIN bridge password")
+			conn.send(":bridge2!bridge@host NICK :bridge")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG NickServ :IDENTIFY bridge password")
+		})
+
+		Convey("It only tries to reclaim its nick without a password", func() {
+			c.IRC.NickServPassword = ""
+			_, stop := startFakeIRCWith(server, c)
+			defer stop()
+
+			conn := server.accept()
+			So(conn, ShouldNotBeNil)
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+			conn.send(":fake.server 433 * bridge :Nickname is already in use")
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge2")
+			conn.send(":fake.server 001 bridge2 :Welcome")
+
+			So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+			conn.send(":bridge2!bridge@host NICK :bridge")
+			conn.send(":fake.server PING :sync")
+			So(conn.expect("P"), ShouldEqual, "PONG :sync")
+			So(iCurrentNick(), ShouldEqual, "bridge")
+		})
+
+		Convey("It follows its own prefix as its nick changes", func() {
+			c.IRC.NickServPassword = ""
+			_, stop := startFakeIRCWith(server, c)
+			defer stop()
+
+			conn := server.accept()
+			So(conn, ShouldNotBeNil)
+			conn.expect("NICK ")
+			conn.send(":fake.server 001 bridge :Welcome")
+			conn.expect("JOIN ")
+			So(iOwnPrefix(), ShouldStartWith, "bridge!~bridge@xxx")
+
+			conn.send(":bridge!~bridge@some.host JOIN #foo")
+			conn.send(":bridge!~bridge@some.host NICK :Guest12345")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+			So(iOwnPrefix(), ShouldEqual, "Guest12345!~bridge@some.host")
+
+			iResetSession()
+			So(iOwnPrefix(), ShouldStartWith, "bridge!~bridge@xxx")
+		})
+	})
+}
+
+func TestIRCCapNegotiation(t *testing.T) {
+	Convey("When the bridge registers with a server which has capabilities", t, func() {
+		server := newFakeIRCServer()
+		_, stop := startFakeIRC(server, map[string]string{"#foo": "guild#foo"})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		So(conn.expect("NICK "), ShouldEqual, "NICK bridge")
+		conn.send(":fake.server 001 bridge :Welcome")
+
+		So(conn.expect("CAP "), ShouldEqual, "CAP LS 302")
+		conn.send(":fake.server CAP bridge LS :echo-message sasl server-time")
+		So(conn.expect("CAP "), ShouldEqual, "CAP REQ :echo-message server-time")
+		conn.send(":fake.server CAP bridge ACK :echo-message server-time")
+		conn.send(":fake.server PING :sync")
+		conn.expect("PONG ")
+
+		So(iHasCap("server-time"), ShouldBeTrue)
+		So(iHasCap("echo-message"), ShouldBeTrue)
+		So(iHasCap("sasl"), ShouldBeFalse)
+
+		Convey("Echoes of its own messages are recognised, so they aren't relayed", func() {
+			So(iOwnMessage(&irc.Event{Nick: "bridge"}), ShouldBeTrue)
+			So(iOwnMessage(&irc.Event{Nick: "Bridge"}), ShouldBeTrue)
+			So(iOwnMessage(&irc.Event{Nick: "other"}), ShouldBeFalse)
+		})
+	})
+}
+
+func TestIRCMembershipRelay(t *testing.T) {
+	Convey("When some mapped channels relay membership changes", t, func() {
+		window := ircNetsplitWindow
+		ircNetsplitWindow = 20 * time.Millisecond
+		defer func() { ircNetsplitWindow = window }()
+		iNetsplits = newNetsplits(iNetsplits.post)
+
+		relayed := make(chan string, 10)
+		ircMembershipNotice = func(channel, message string) { relayed <- channel + " " + message }
+		defer func() { ircMembershipNotice = incomingIRCMembership }()
+
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Mapping: map[string]string{"#foo": "guild#foo", "#bar": "guild#bar"},
+			Channels: map[string]ChannelConfig{
+				"#foo": {RelayJoins: true, RelayParts: true, RelayQuits: true, RelayKicks: true, RelayNicks: true},
+			},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(2)
+		conn.send(":bridge!bridge@host JOIN #foo")
+		conn.send(":fake.server 353 bridge = #foo :@op +voiced @+both bridge")
+		conn.send(":bridge!bridge@host JOIN #bar")
+		conn.send(":fake.server 353 bridge = #bar :op other bridge")
+
+		Convey("Joins, parts, kicks, nick changes and quits are relayed", func() {
+			conn.send(":new!new@host JOIN #foo")
+			So(receive(relayed), ShouldEqual, "#foo new has joined")
+			conn.send(":new!new@host PART #foo :bye")
+			So(receive(relayed), ShouldEqual, "#foo new has left (bye)")
+			conn.send(":op!op@host KICK #foo voiced :spam")
+			So(receive(relayed), ShouldEqual, "#foo voiced was kicked by op (spam)")
+			conn.send(":both!both@host NICK :both2")
+			So(receive(relayed), ShouldEqual, "#foo both is now known as both2")
+			conn.send(":both2!both@host QUIT :Quit: bye")
+			So(receive(relayed), ShouldEqual, "#foo both2 has quit (Quit: bye)")
+
+			Convey("Only to the channels the user was in which relay them", func() {
+				conn.send(":other!other@host QUIT :Ping timeout")
+				conn.send(":op!op@host NICK :op2")
+				So(receive(relayed), ShouldEqual, "#foo op is now known as op2")
+				conn.send(":fake.server PING :sync")
+				conn.expect("PONG ")
+				So(len(relayed), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Quits from a netsplit are summarised", func() {
+			conn.send(":op!op@host QUIT :hub.example.net leaf.example.net")
+			conn.send(":voiced!voiced@host QUIT :hub.example.net leaf.example.net")
+			conn.send(":both!both@host QUIT :hub.example.net leaf.example.net")
+			So(receive(relayed), ShouldEqual, "#foo Netsplit between hub.example.net and leaf.example.net: op, voiced and both have quit")
+		})
+	})
+}
+
+func TestIRCTopicSync(t *testing.T) {
+	Convey("When a mapping synchronises topics both ways", t, func() {
+		iTopics = newTopicSync()
+		topics := make(chan string, 10)
+		discordTopic = func(channel, nick, topic string) { topics <- channel + " " + nick + ": " + topic }
+		defer func() { discordTopic = dSetTopic }()
+
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Mapping:  map[string]string{"#foo": "guild#foo", "#bar": "guild#bar"},
+			Channels: map[string]ChannelConfig{"#foo": {TopicSync: "both"}},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(2)
+		conn.send(":fake.server 332 bridge #foo :the \x02topic\x02")
+		conn.send(":fake.server 332 bridge #bar :unsynchronised")
+		So(receive(topics), ShouldEqual, "guild#foo : the topic")
+
+		Convey("IRC topic changes are mirrored to Discord", func() {
+			conn.send(":op!op@host TOPIC #foo :a new topic")
+			So(receive(topics), ShouldEqual, "guild#foo op: a new topic")
+
+			Convey("But not pushed back when Discord echoes them", func() {
+				incomingDiscordTopic("guild#foo", "a new topic")
+				incomingDiscordTopic("guild#foo", "from discord")
+				So(conn.expect("TOPIC "), ShouldEqual, "TOPIC #foo :from discord")
+			})
+		})
+
+		Convey("Discord topic changes are pushed to IRC", func() {
+			incomingDiscordTopic("guild#bar", "unmapped")
+			incomingDiscordTopic("guild#foo", "from\ndiscord")
+			So(conn.expect("TOPIC "), ShouldEqual, "TOPIC #foo :from discord")
+
+			Convey("But not mirrored back when IRC echoes them", func() {
+				conn.send(":bridge!bridge@host TOPIC #foo :from discord")
+				conn.send(":fake.server 332 bridge #foo :from discord")
+				conn.send(":fake.server PING :sync")
+				conn.expect("PONG ")
+				So(len(topics), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestIRCTopicSyncToIRC(t *testing.T) {
+	Convey("When a mapping only pushes Discord topics to IRC", t, func() {
+		iTopics = newTopicSync()
+		topics := make(chan string, 10)
+		discordTopic = func(channel, nick, topic string) { topics <- channel + " " + nick + ": " + topic }
+		defer func() { discordTopic = dSetTopic }()
+
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Mapping:  map[string]string{"#foo": "guild#foo"},
+			Channels: map[string]ChannelConfig{"#foo": {TopicSync: "to_irc"}},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(1)
+		conn.send(":fake.server 332 bridge #foo :the topic")
+		conn.send(":fake.server PING :sync")
+		conn.expect("PONG ")
+
+		Convey("IRC topics aren't mirrored to Discord", func() {
+			conn.send(":op!op@host TOPIC #foo :a new topic")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+			So(len(topics), ShouldEqual, 0)
+		})
+
+		Convey("Discord only pushes topics IRC doesn't already have", func() {
+			incomingDiscordTopic("guild#foo", "the topic")
+			incomingDiscordTopic("guild#foo", "a new topic")
+			So(conn.expect("TOPIC "), ShouldEqual, "TOPIC #foo :a new topic")
+		})
+
+		Convey("Topics are shortened to the length the server allows", func() {
+			conn.send(":fake.server 005 bridge TOPICLEN=10 :are supported by this server")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+
+			incomingDiscordTopic("guild#foo", "a topic longer than the server allows")
+			So(conn.expect("TOPIC "), ShouldEqual, "TOPIC #foo :a topic lo")
+		})
+	})
+}
+
+func TestIRCNoticeFromDiscord(t *testing.T) {
+	Convey("When Discord messages can be sent as NOTICEs", t, func() {
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Discord: DiscordConfig{NoticePrefix: "!notice "},
+			Mapping: map[string]string{"#foo": "guild#foo"},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(1)
+
+		Convey("Messages with the prefix are sent as NOTICEs", func() {
+			incomingDiscord("someone", "guild#foo", "!notice **hello**")
+			So(conn.expect("NOTICE "), ShouldEqual, "NOTICE #foo :\x02<s\uFEFFomeone>\x02 \x02hello")
+		})
+
+		Convey("Other messages are sent as PRIVMSGs", func() {
+			incomingDiscord("someone", "guild#foo", "!noticeable")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 !noticeable")
+		})
+	})
+}
+
+func TestIRCCTCP(t *testing.T) {
+	Convey("When the bridge is sent CTCP queries", t, func() {
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			IRC:     IRCConfig{Nick: "bridge", User: "bridge", CTCPVersion: "custom version"},
+			Mapping: map[string]string{"#foo": "guild#foo"},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(1)
+
+		conn.send(":someone!someone@host PRIVMSG bridge :\x01VERSION\x01")
+		So(conn.expect("NOTICE "), ShouldEqual, "NOTICE someone :\x01VERSION custom version\x01")
+		conn.send(":someone!someone@host PRIVMSG #foo :\x01PING 1234567890\x01")
+		So(conn.expect("NOTICE "), ShouldEqual, "NOTICE someone :\x01PING 1234567890\x01")
+		conn.send(":someone!someone@host PRIVMSG bridge :\x01USERINFO\x01")
+		conn.send(":bridge!bridge@host PRIVMSG #foo :\x01SOURCE\x01")
+		conn.send(":someone!someone@host PRIVMSG bridge :\x01SOURCE\x01")
+		So(conn.expect("NOTICE "), ShouldEqual, "NOTICE someone :\x01SOURCE https://github.com/GinjaNinja32/DisGoIRC\x01")
+	})
+
+	Convey("When CTCP replies are generated", t, func() {
+		conf = Config{}
+		now := time.Date(2020, time.February, 3, 4, 5, 6, 0, time.UTC)
+		tests := []struct {
+			command, args string
+			reply         string
+			ok            bool
+		}{
+			{"VERSION", "", "VERSION DisGoIRC - https://github.com/GinjaNinja32/DisGoIRC", true},
+			{"source", "", "SOURCE https://github.com/GinjaNinja32/DisGoIRC", true},
+			{"TIME", "", "TIME Mon, 03 Feb 2020 04:05:06 +0000", true},
+			{"PING", "", "PING", true},
+			{"PING", "123 456", "PING 123 456", true},
+			{"CLIENTINFO", "", "CLIENTINFO ACTION CLIENTINFO PING SOURCE TIME VERSION", true},
+			{"USERINFO", "", "", false},
+			{"DCC", "SEND file", "", false},
+		}
+		for _, test := range tests {
+			reply, ok := iCTCPReply(test.command, test.args, now)
+			So(reply, ShouldEqual, test.reply)
+			So(ok, ShouldEqual, test.ok)
+		}
+	})
+}
+
+func TestIRCActionFromDiscord(t *testing.T) {
+	Convey("When a Discord user uses /me", t, func() {
+		server := newFakeIRCServer()
+		_, stop := startFakeIRC(server, map[string]string{"#foo": "guild#foo"})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(1)
+
+		incomingDiscord("someone", "guild#foo", "_waves **hello**_")
+		So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x01ACTION \x02s\uFEFFomeone\x02 waves \x02hello\x01")
+	})
+}
+
+func TestIRCReplyFromDiscord(t *testing.T) {
+	Convey("When a Discord reply is relayed", t, func() {
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Discord: DiscordConfig{CommandChars: "!", NoticePrefix: "!notice ", MaxLines: 5},
+			Mapping: map[string]string{"#foo": "guild#foo"},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.register(1)
+
+		context := ircReplyContext("bob", "hi")
+
+		Convey("The context is sent before the first line", func() {
+			dispatchReplyToIRC("someone", "guild#foo", context, "hello\nagain")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 re bob: \"hi\": hello")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 again")
+		})
+
+		Convey("A command is still sent as a command", func() {
+			dispatchReplyToIRC("someone", "guild#foo", context, "!help")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :Command sent by someone (re bob: \"hi\")")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :!help")
+		})
+
+		Convey("An action is still sent as an action", func() {
+			dispatchReplyToIRC("someone", "guild#foo", context, "_waves_")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x01ACTION \x02s\uFEFFomeone\x02 re bob: \"hi\": waves\x01")
+		})
+
+		Convey("A NOTICE is still sent as a NOTICE", func() {
+			dispatchReplyToIRC("someone", "guild#foo", context, "!notice hello")
+			So(conn.expect("NOTICE "), ShouldEqual, "NOTICE #foo :\x02<s\uFEFFomeone>\x02 re bob: \"hi\": hello")
+		})
+	})
+}
+
+func TestIRCEditFromDiscord(t *testing.T) {
+	Convey("When a Discord user edits a relayed message", t, func() {
+		relayedMessages = newMemoryStore(defaultStoreMaxMessages, defaultStoreMaxAge, realClock{})
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Discord: DiscordConfig{MaxLines: 5},
+			Mapping: map[string]string{"#foo": "guild#foo"},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.expect("NICK ")
+		conn.send(":fake.server 001 bridge :Welcome")
+		So(conn.expect("CAP "), ShouldEqual, "CAP LS 302")
+		conn.expect("JOIN ")
+
+		Convey("Small changes are sent as a substitution", func() {
+			incomingDiscordEdit("someone", "guild#foo", "I think teh cat is asleep", "I think the cat is asleep", "")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 s/teh/the/")
+		})
+
+		Convey("Other changes send the message again", func() {
+			incomingDiscordEdit("someone", "guild#foo", "teh cat", "the cat", "")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 the cat (edited)")
+		})
+
+		Convey("Edited commands aren't sent again", func() {
+			conf.Discord.CommandChars = "="
+			incomingDiscordEdit("someone", "guild#foo", "=roll", "=roll 2d6", "")
+			incomingDiscordEdit("someone", "guild#foo", "teh cat", "the cat", "")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 the cat (edited)")
+		})
+
+		Convey("If the server can edit messages, the original message is edited", func() {
+			conn.send(":fake.server CAP bridge LS :draft/message-edit echo-message message-tags")
+			So(conn.expect("CAP "), ShouldEqual, "CAP REQ :draft/message-edit echo-message message-tags")
+			conn.send(":fake.server CAP bridge ACK :draft/message-edit echo-message message-tags")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+
+			relayFromDiscord(conn, "d1", "someone", "guild#foo", "teh cat", "abc123")
+			relayed, ok := relayedMessages.byDiscordID("d1")
+			So(ok, ShouldBeTrue)
+			So(relayed.IRCMsgID, ShouldEqual, "abc123")
+
+			incomingDiscordEdit("someone", "guild#foo", "teh cat", "the cat", relayed.IRCMsgID)
+			So(conn.expect("@"), ShouldEqual, "@+draft/edit=abc123 PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 the cat")
+
+			Convey("Messages with the same text each get their own msgid", func() {
+				dRememberRelayed("guild#foo", "someone", "", "ok", &discord.Message{ID: "d2", ChannelID: "c"})
+				dRememberRelayed("guild#foo", "someone", "", "ok", &discord.Message{ID: "d3", ChannelID: "c"})
+				conn.send("@msgid=m2 :bridge!bridge@host PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 ok")
+				conn.send("@msgid=m3 :bridge!bridge@host PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 ok")
+				conn.send(":fake.server PING :sync")
+				conn.expect("PONG ")
+
+				relayed, _ := relayedMessages.byDiscordID("d2")
+				So(relayed.IRCMsgID, ShouldEqual, "m2")
+				relayed, _ = relayedMessages.byDiscordID("d3")
+				So(relayed.IRCMsgID, ShouldEqual, "m3")
+			})
+
+			Convey("Actions and notices are matched to the command they were sent as", func() {
+				conf.Discord.NoticePrefix = "!"
+				dRememberRelayed("guild#foo", "someone", "", "_waves_", &discord.Message{ID: "d2", ChannelID: "c"})
+				dRememberRelayed("guild#foo", "someone", "", "!hello", &discord.Message{ID: "d3", ChannelID: "c"})
+				conn.send("@msgid=m1 :bridge!bridge@host PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 hello")
+				conn.send("@msgid=m2 :bridge!bridge@host PRIVMSG #foo :\x01ACTION \x02s\uFEFFomeone\x02 waves\x01")
+				conn.send("@msgid=m3 :bridge!bridge@host NOTICE #foo :\x02<s\uFEFFomeone>\x02 hello")
+				conn.send(":fake.server PING :sync")
+				conn.expect("PONG ")
+
+				relayed, _ := relayedMessages.byDiscordID("d2")
+				So(relayed.IRCMsgID, ShouldEqual, "m2")
+				relayed, _ = relayedMessages.byDiscordID("d3")
+				So(relayed.IRCMsgID, ShouldEqual, "m3")
+			})
+		})
+	})
+}
+
+// relayFromDiscord relays `message` as the Discord message `id` from `nick` in `channel`, and echoes it back from the
+// server with the msgid `msgID`
+func relayFromDiscord(conn *fakeIRCConn, id, nick, channel, message, msgID string) {
+	dRememberRelayed(channel, nick, "", message, &discord.Message{ID: id, ChannelID: "c"})
+	incomingDiscord(nick, channel, message)
+	line := conn.expect("PRIVMSG ")
+	So(line, ShouldEqual, "PRIVMSG "+inverseMapping[channel]+" :\x02<"+iAddAntiPing(nick)+">\x02 "+message)
+	conn.send("@msgid=" + msgID + " :bridge!bridge@host " + line)
+	conn.send(":fake.server PING :sync")
+	conn.expect("PONG ")
+}
+
+func TestIRCDeletes(t *testing.T) {
+	Convey("When relayed messages are deleted", t, func() {
+		relayedMessages = newMemoryStore(defaultStoreMaxMessages, defaultStoreMaxAge, realClock{})
+		deleted := make(chan string, 10)
+		discordDelete = func(m relayedMessage) { deleted <- m.DiscordChanID + " " + m.DiscordID }
+		defer func() { discordDelete = dDeleteMessage }()
+
+		server := newFakeIRCServer()
+		_, stop := startFakeIRCWith(server, Config{
+			Mapping: map[string]string{"#foo": "guild#foo", "#bar": "guild#bar", "#baz": "guild#baz"},
+			Channels: map[string]ChannelConfig{
+				"#foo": {RelayDeletes: "note"},
+				"#bar": {RelayDeletes: "redact"},
+			},
+		})
+		defer stop()
+
+		conn := server.accept()
+		So(conn, ShouldNotBeNil)
+		conn.expect("NICK ")
+		conn.send(":fake.server 001 bridge :Welcome")
+		So(conn.expect("CAP "), ShouldEqual, "CAP LS 302")
+		conn.expect("JOIN ")
+		conn.expect("JOIN ")
+		conn.expect("JOIN ")
+
+		Convey("Deleting a message on Discord posts a note to IRC, if the mapping relays deletions", func() {
+			incomingDiscordDelete("someone", "guild#baz", []string{""})
+			incomingDiscordDelete("someone", "guild#foo", []string{""})
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 [message deleted]")
+
+			incomingDiscordDelete("someone", "guild#foo", []string{"", "", ""})
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #foo :\x02<s\uFEFFomeone>\x02 [3 messages deleted]")
+		})
+
+		Convey("Deleting a message on Discord redacts it on IRC, if the server can", func() {
+			conn.send(":fake.server CAP bridge LS :draft/message-redaction echo-message")
+			So(conn.expect("CAP "), ShouldEqual, "CAP REQ :draft/message-redaction echo-message")
+			conn.send(":fake.server CAP bridge ACK :draft/message-redaction echo-message")
+			conn.send(":fake.server PING :sync")
+			conn.expect("PONG ")
+
+			relayFromDiscord(conn, "d1", "someone", "guild#bar", "hello", "abc123")
+
+			incomingDiscordDelete("someone", "guild#bar", []string{"abc123", ""})
+			So(conn.expect("REDACT "), ShouldEqual, "REDACT #bar :abc123")
+			So(conn.expect("PRIVMSG "), ShouldEqual, "PRIVMSG #bar :\x02<s\uFEFFomeone>\x02 [message deleted]")
+		})
+
+		Convey("Redacting a message on IRC deletes its copy from Discord", func() {
+			dRememberCopy(relayedMessage{FromIRC: true, Channel: "guild#foo", DiscordChanID: "c", IRCMsgID: "m1", Nick: "someone"}, "d1")
+			conn.send(":op!op@host REDACT #foo m2")
+			conn.send(":op!op@host REDACT #foo m1 :spam")
+			So(receive(deleted), ShouldEqual, "c d1")
+		})
+
+		Convey("Channel operators can delete the copy of someone's last message from Discord", func() {
+			conn.send(":bridge!bridge@host JOIN #foo")
+			conn.send(":fake.server 353 bridge = #foo :@op voiced bridge")
+			dRememberCopy(relayedMessage{FromIRC: true, Channel: "guild#foo", DiscordChanID: "c", Nick: "someone"}, "d1")
+			dRememberCopy(relayedMessage{FromIRC: true, Channel: "guild#foo", DiscordChanID: "c", Nick: "someone"}, "d2")
+
+			conn.send(":op!op@host PRIVMSG #foo :bridge: delete someone")
+			So(receive(deleted), ShouldEqual, "c d2")
+			So(conn.expect("NOTICE "), ShouldEqual, "NOTICE op :Deleted the last message from someone in #foo from Discord")
+
+			conn.send(":op!op@host PRIVMSG #foo :Bridge, delete Someone")
+			So(receive(deleted), ShouldEqual, "c d1")
+			conn.expect("NOTICE ")
+
+			conn.send(":op!op@host PRIVMSG #foo :bridge: delete someone")
+			So(conn.expect("NOTICE "), ShouldEqual, "NOTICE op :There is no recent message from someone in #foo to delete from Discord")
+
+			Convey("Operator status follows mode changes", func() {
+				So(iIsOp("#foo", "op"), ShouldBeTrue)
+				So(iIsOp("#foo", "voiced"), ShouldBeFalse)
+
+				conn.send(":op!op@host MODE #foo -o+o op voiced")
+				conn.send(":op!op@host NICK newop")
+				conn.send(":fake.server PING :sync")
+				conn.expect("PONG ")
+				So(iIsOp("#foo", "op"), ShouldBeFalse)
+				So(iIsOp("#foo", "voiced"), ShouldBeTrue)
+
+				conn.send(":voiced!voiced@host NICK newvoiced")
+				conn.send(":fake.server PING :sync")
+				conn.expect("PONG ")
+				So(iIsOp("#foo", "newvoiced"), ShouldBeTrue)
+			})
+		})
+	})
+}
@@ -0,0 +1,174 @@
+package bot
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+// ircWantedCaps are the IRCv3 capabilities we ask for whenever the server has them
+// Features which depend on a capability check iHasCap before relying on it, since the server may not have it
+var ircWantedCaps = []string{
+	"account-tag",
+	"away-notify",
+	"cap-notify",
+	ircMessageEditCap,
+	ircMessageRedactionCap,
+	"echo-message",
+	"message-tags",
+	"multi-prefix",
+	"server-time",
+}
+
+// iCaps tracks capability negotiation on the current connection to IRC
+var iCaps = newIRCCaps(ircWantedCaps)
+
+// ircCaps negotiates IRCv3 capabilities with a server, following the CAP messages it sends
+// See https://ircv3.net/specs/extensions/capability-negotiation
+//
+// go-ircevent negotiates SASL itself before registering, so this only takes part once registration is complete, when
+// start is called; servers allow capabilities to be requested at any time, and any sent before then are ignored
+type ircCaps struct {
+	wanted []string
+
+	lock      sync.Mutex
+	active    bool
+	listing   []string          // capabilities from a multi-line LS which hasn't finished yet
+	available map[string]string // capabilities the server has, with their values
+	enabled   map[string]bool   // capabilities the server has ACKed
+}
+
+func newIRCCaps(wanted []string) *ircCaps {
+	return &ircCaps{wanted: wanted, available: map[string]string{}, enabled: map[string]bool{}}
+}
+
+// start forgets any capabilities from a previous connection, returning the line to send to begin negotiating again
+func (c *ircCaps) start() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.active = true
+	c.listing = nil
+	c.available = map[string]string{}
+	c.enabled = map[string]bool{}
+
+	return "CAP LS 302"
+}
+
+// stop ignores CAP messages until start is called again, e.g. while reconnecting
+func (c *ircCaps) stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.active = false
+	c.enabled = map[string]bool{}
+}
+
+// has returns whether the server has ACKed a capability
+func (c *ircCaps) has(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.enabled[name]
+}
+
+// list returns the capabilities the server has ACKed, sorted by name
+func (c *ircCaps) list() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	names := []string{}
+	for name := range c.enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handle follows a CAP message from the server, given its arguments after "CAP", returning any lines to send back
+// e.g. ["*", "LS", "*", "multi-prefix sasl=PLAIN"] or ["nick", "ACK", "multi-prefix"]
+func (c *ircCaps) handle(args []string) []string {
+	if len(args) < 3 {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.active {
+		return nil
+	}
+
+	caps := strings.Fields(args[len(args)-1])
+	switch strings.ToUpper(args[1]) {
+	case "LS":
+		c.listing = append(c.listing, caps...)
+		if len(args) > 3 && args[2] == "*" {
+			// More LS lines are coming
+			return nil
+		}
+		listed := c.listing
+		c.listing = nil
+		return c.request(listed)
+	case "NEW":
+		return c.request(caps)
+	case "DEL":
+		for _, name := range caps {
+			delete(c.available, name)
+			delete(c.enabled, name)
+		}
+	case "ACK":
+		for _, name := range caps {
+			if strings.HasPrefix(name, "-") {
+				delete(c.enabled, name[1:])
+			} else {
+				c.enabled[name] = true
+			}
+		}
+	case "NAK":
+		log.Warnf("IRC server refused capabilities: %s", strings.Join(caps, " "))
+	}
+	return nil
+}
+
+// request records newly available capabilities, returning a CAP REQ for those we want but haven't enabled
+func (c *ircCaps) request(caps []string) []string {
+	for _, token := range caps {
+		name, value := token, ""
+		if i := strings.IndexByte(token, '='); i != -1 {
+			name, value = token[:i], token[i+1:]
+		}
+		c.available[name] = value
+	}
+
+	wanted := []string{}
+	for _, name := range c.wanted {
+		if _, ok := c.available[name]; ok && !c.enabled[name] {
+			wanted = append(wanted, name)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	return []string{"CAP REQ :" + strings.Join(wanted, " ")}
+}
+
+// iHasCap returns whether the IRC server has enabled a capability on the current connection
+func iHasCap(name string) bool {
+	return iCaps.has(name)
+}
+
+// iCap follows capability negotiation with the IRC server
+func iCap(e *irc.Event) {
+	before := iCaps.list()
+	for _, line := range iCaps.handle(e.Arguments) {
+		iSession.SendRaw(line)
+	}
+
+	if after := iCaps.list(); strings.Join(after, " ") != strings.Join(before, " ") {
+		log.Infof("IRC capabilities enabled: %s", strings.Join(after, " "))
+	}
+}
@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// ircCapExchange is a CAP message from the server, and what the client should send back
+type ircCapExchange struct {
+	received string
+	sent     []string
+}
+
+// capArguments splits a CAP message from the server into its arguments after "CAP", as go-ircevent does
+func capArguments(line string) []string {
+	split := strings.SplitN(line, " :", 2)
+	args := strings.Split(split[0], " ")[2:]
+	if len(split) > 1 {
+		args = append(args, split[1])
+	}
+	return args
+}
+
+func TestIRCCaps(t *testing.T) {
+	wanted := []string{"away-notify", "multi-prefix", "server-time"}
+
+	tests := []struct {
+		name      string
+		exchanges []ircCapExchange
+		enabled   []string
+	}{
+		{
+			name: "single LS",
+			exchanges: []ircCapExchange{
+				{":irc.example.com CAP bridge LS :multi-prefix sasl=PLAIN,EXTERNAL server-time", []string{"CAP REQ :multi-prefix server-time"}},
+				{":irc.example.com CAP bridge ACK :multi-prefix server-time", nil},
+			},
+			enabled: []string{"multi-prefix", "server-time"},
+		},
+		{
+			name: "multi-line LS",
+			exchanges: []ircCapExchange{
+				{":irc.example.com CAP bridge LS * :away-notify extended-join", nil},
+				{":irc.example.com CAP bridge LS * :sasl=PLAIN", nil},
+				{":irc.example.com CAP bridge LS :server-time", []string{"CAP REQ :away-notify server-time"}},
+				{":irc.example.com CAP bridge ACK :away-notify server-time", nil},
+			},
+			enabled: []string{"away-notify", "server-time"},
+		},
+		{
+			name: "nothing wanted",
+			exchanges: []ircCapExchange{
+				{":irc.example.com CAP bridge LS :sasl extended-join", nil},
+			},
+			enabled: []string{},
+		},
+		{
+			name: "NAK",
+			exchanges: []ircCapExchange{
+				{":irc.example.com CAP bridge LS :multi-prefix", []string{"CAP REQ :multi-prefix"}},
+				{":irc.example.com CAP bridge NAK :multi-prefix", nil},
+			},
+			enabled: []string{},
+		},
+		{
+			name: "NEW and DEL",
+			exchanges: []ircCapExchange{
+				{":irc.example.com CAP bridge LS :multi-prefix", []string{"CAP REQ :multi-prefix"}},
+				{":irc.example.com CAP bridge ACK multi-prefix", nil},
+				{":irc.example.com CAP bridge NEW :server-time extended-join", []string{"CAP REQ :server-time"}},
+				{":irc.example.com CAP bridge ACK :server-time", nil},
+				{":irc.example.com CAP bridge DEL :multi-prefix", nil},
+			},
+			enabled: []string{"server-time"},
+		},
+		{
+			name: "disabled by ACK",
+			exchanges: []ircCapExchange{
+				{":irc.example.com CAP bridge LS :away-notify server-time", []string{"CAP REQ :away-notify server-time"}},
+				{":irc.example.com CAP bridge ACK :away-notify server-time", nil},
+				{":irc.example.com CAP bridge ACK :-away-notify", nil},
+			},
+			enabled: []string{"server-time"},
+		},
+	}
+
+	Convey("When capabilities are negotiated", t, func() {
+		for _, test := range tests {
+			Convey(test.name, func() {
+				caps := newIRCCaps(wanted)
+				So(caps.start(), ShouldEqual, "CAP LS 302")
+				for _, exchange := range test.exchanges {
+					So(caps.handle(capArguments(exchange.received)), ShouldResemble, exchange.sent)
+				}
+				So(caps.list(), ShouldResemble, test.enabled)
+				for _, name := range test.enabled {
+					So(caps.has(name), ShouldBeTrue)
+				}
+			})
+		}
+	})
+
+	Convey("When go-ircevent is negotiating SASL before registration", t, func() {
+		caps := newIRCCaps(wanted)
+
+		Convey("Its CAP messages are left to it", func() {
+			So(caps.handle(capArguments(":irc.example.com CAP * LS :multi-prefix sasl")), ShouldBeNil)
+			So(caps.handle(capArguments(":irc.example.com CAP * ACK :sasl")), ShouldBeNil)
+			So(caps.list(), ShouldResemble, []string{})
+		})
+
+		Convey("Nothing is enabled after reconnecting until the server ACKs it again", func() {
+			caps.start()
+			caps.handle(capArguments(":irc.example.com CAP bridge LS :multi-prefix"))
+			caps.handle(capArguments(":irc.example.com CAP bridge ACK :multi-prefix"))
+			So(caps.has("multi-prefix"), ShouldBeTrue)
+
+			caps.stop()
+			So(caps.has("multi-prefix"), ShouldBeFalse)
+			So(caps.handle(capArguments(":irc.example.com CAP bridge ACK :multi-prefix")), ShouldBeNil)
+			So(caps.has("multi-prefix"), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,318 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	irc "github.com/thoj/go-ircevent"
+)
+
+// ircMembers tracks who is in each IRC channel we are in, so that we know which channels a QUIT or NICK affects, and
+// the channel status of each, e.g. "@" for ops
+// Channels are keyed by lowercased name, and nicks by lowercased nick
+type ircMembers struct {
+	lock     sync.Mutex
+	channels map[string]map[string]string
+	statuses map[string]map[string]string // status symbols of the members who have any
+}
+
+func newIRCMembers() *ircMembers {
+	return &ircMembers{channels: map[string]map[string]string{}, statuses: map[string]map[string]string{}}
+}
+
+// reset forgets who is in `channel`, e.g. when we join it and the server is about to list its members
+func (m *ircMembers) reset(channel string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.channels[strings.ToLower(channel)] = map[string]string{}
+	m.statuses[strings.ToLower(channel)] = map[string]string{}
+}
+
+// forget stops tracking `channel`, when we leave it, or every channel if `channel` is ""
+func (m *ircMembers) forget(channel string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if channel == "" {
+		m.channels = map[string]map[string]string{}
+		m.statuses = map[string]map[string]string{}
+		return
+	}
+	delete(m.channels, strings.ToLower(channel))
+	delete(m.statuses, strings.ToLower(channel))
+}
+
+// join adds `nick` to `channel`, if we are tracking it
+func (m *ircMembers) join(channel, nick string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if members, ok := m.channels[strings.ToLower(channel)]; ok {
+		members[strings.ToLower(nick)] = nick
+	}
+}
+
+// part removes `nick` from `channel`, returning whether they were in it
+func (m *ircMembers) part(channel, nick string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	members := m.channels[strings.ToLower(channel)]
+	if _, ok := members[strings.ToLower(nick)]; !ok {
+		return false
+	}
+	delete(members, strings.ToLower(nick))
+	delete(m.statuses[strings.ToLower(channel)], strings.ToLower(nick))
+	return true
+}
+
+// quit removes `nick` from every channel, returning the channels they were in
+func (m *ircMembers) quit(nick string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	channels := []string{}
+	for channel, members := range m.channels {
+		if _, ok := members[strings.ToLower(nick)]; ok {
+			delete(members, strings.ToLower(nick))
+			delete(m.statuses[channel], strings.ToLower(nick))
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// rename changes `from` to `to` in every channel, returning the channels they are in
+func (m *ircMembers) rename(from, to string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	channels := []string{}
+	for channel, members := range m.channels {
+		if _, ok := members[strings.ToLower(from)]; ok {
+			delete(members, strings.ToLower(from))
+			members[strings.ToLower(to)] = to
+			if status, ok := m.statuses[channel][strings.ToLower(from)]; ok {
+				delete(m.statuses[channel], strings.ToLower(from))
+				m.statuses[channel][strings.ToLower(to)] = status
+			}
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// setStatus records the status symbols `nick` has in `channel`, e.g. "@+" from NAMES with multi-prefix
+func (m *ircMembers) setStatus(channel, nick, symbols string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	statuses, ok := m.statuses[strings.ToLower(channel)]
+	if !ok {
+		return
+	}
+	if symbols == "" {
+		delete(statuses, strings.ToLower(nick))
+	} else {
+		statuses[strings.ToLower(nick)] = symbols
+	}
+}
+
+// changeStatus gives `nick` the status `symbol` in `channel`, or takes it away if not `set`, following a MODE
+func (m *ircMembers) changeStatus(channel, nick string, symbol byte, set bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	statuses, ok := m.statuses[strings.ToLower(channel)]
+	if !ok {
+		return
+	}
+	status := strings.Replace(statuses[strings.ToLower(nick)], string(symbol), "", -1)
+	if set {
+		status += string(symbol)
+	}
+	if status == "" {
+		delete(statuses, strings.ToLower(nick))
+	} else {
+		statuses[strings.ToLower(nick)] = status
+	}
+}
+
+// hasStatus returns whether `nick` has any of the status `symbols` in `channel`
+func (m *ircMembers) hasStatus(channel, nick, symbols string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return strings.ContainsAny(m.statuses[strings.ToLower(channel)][strings.ToLower(nick)], symbols)
+}
+
+// list returns the nicks in `channel`, sorted case-insensitively
+func (m *ircMembers) list(channel string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	members := m.channels[strings.ToLower(channel)]
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nicks := make([]string, 0, len(keys))
+	for _, key := range keys {
+		nicks = append(nicks, members[key])
+	}
+	return nicks
+}
+
+var (
+	// iMembers tracks who is in the channels we are in on the current connection to IRC
+	iMembers = newIRCMembers()
+
+	// iPrefixSymbols are the symbols the server puts before nicks in NAMES for their channel status, e.g. "@" for ops
+	iPrefixSymbols = "~&@%+"
+)
+
+// ircMembershipNotice posts a line about someone joining, leaving or changing nick in a mapped IRC channel to Discord
+var ircMembershipNotice = incomingIRCMembership
+
+// iRelayMembership posts `message` to the Discord channel mapped to `channel` if `enabled` says it should be relayed
+func iRelayMembership(channel string, enabled func(ChannelConfig) bool, message string) {
+	if enabled(channelConfigs[strings.ToLower(channel)]) {
+		ircMembershipNotice(strings.ToLower(channel), message)
+	}
+}
+
+// iNames records the members of a channel from RPL_NAMREPLY, e.g. "353 bridge = #foo :@op +voiced someone"
+func iNames(e *irc.Event) {
+	if len(e.Arguments) < 4 {
+		return
+	}
+
+	iChannelLock.Lock()
+	symbols := iPrefixSymbols
+	iChannelLock.Unlock()
+
+	for _, nick := range strings.Fields(e.Arguments[3]) {
+		// With multi-prefix, every status the member has is listed, e.g. "@+someone"
+		name := strings.TrimLeft(nick, symbols)
+		iMembers.join(e.Arguments[2], name)
+		iMembers.setStatus(e.Arguments[2], name, nick[:len(nick)-len(name)])
+	}
+}
+
+// iIsOp returns whether `nick` is an operator in `channel`, or has a higher status, e.g. "~" for the owner
+func iIsOp(channel, nick string) bool {
+	iChannelLock.Lock()
+	symbols := iPrefixSymbols
+	iChannelLock.Unlock()
+
+	// The server lists the status symbols from highest to lowest
+	if i := strings.IndexByte(symbols, '@'); i != -1 {
+		symbols = symbols[:i+1]
+	} else {
+		symbols = "@"
+	}
+	return iMembers.hasStatus(channel, nick, symbols)
+}
+
+// iMemberJoin tracks and relays someone joining a channel
+func iMemberJoin(e *irc.Event) {
+	if len(e.Arguments) < 1 {
+		return
+	}
+	channel := e.Arguments[0]
+
+	if strings.EqualFold(e.Nick, iCurrentNick()) {
+		iMembers.reset(channel)
+		return
+	}
+
+	iMembers.join(channel, e.Nick)
+	iRelayMembership(channel, func(c ChannelConfig) bool { return c.RelayJoins },
+		fmt.Sprintf("%s has joined", e.Nick))
+}
+
+// iMemberPart tracks and relays someone leaving a channel
+func iMemberPart(e *irc.Event) {
+	if len(e.Arguments) < 1 {
+		return
+	}
+	channel := e.Arguments[0]
+
+	if strings.EqualFold(e.Nick, iCurrentNick()) {
+		iMembers.forget(channel)
+		return
+	}
+
+	iMembers.part(channel, e.Nick)
+	iRelayMembership(channel, func(c ChannelConfig) bool { return c.RelayParts },
+		fmt.Sprintf("%s has left%s", e.Nick, withReason(e.Arguments[1:])))
+}
+
+// iMemberKick tracks and relays someone being kicked from a channel
+// e.g. ":op!op@host KICK #foo someone :reason"
+func iMemberKick(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	channel, nick := e.Arguments[0], e.Arguments[1]
+
+	if strings.EqualFold(nick, iCurrentNick()) {
+		iMembers.forget(channel)
+	} else {
+		iMembers.part(channel, nick)
+	}
+
+	iRelayMembership(channel, func(c ChannelConfig) bool { return c.RelayKicks },
+		fmt.Sprintf("%s was kicked by %s%s", nick, e.Nick, withReason(e.Arguments[2:])))
+}
+
+// iMemberQuit tracks and relays someone quitting IRC to every channel they were in
+// Quits caused by a netsplit are collected into one summary for each channel instead
+func iMemberQuit(e *irc.Event) {
+	channels := iMembers.quit(e.Nick)
+	reason := e.Message()
+
+	if servers, ok := netsplitServers(reason); ok {
+		for _, channel := range channels {
+			if channelConfigs[channel].RelayQuits {
+				iNetsplits.add(channel, servers, e.Nick)
+			}
+		}
+		return
+	}
+
+	for _, channel := range channels {
+		iRelayMembership(channel, func(c ChannelConfig) bool { return c.RelayQuits },
+			fmt.Sprintf("%s has quit%s", e.Nick, withReason([]string{reason})))
+	}
+}
+
+// iMemberNick tracks and relays someone changing their nick to every channel they are in
+func iMemberNick(e *irc.Event) {
+	nick := e.Message()
+	channels := iMembers.rename(e.Nick, nick)
+
+	if strings.EqualFold(e.Nick, iCurrentNick()) || strings.EqualFold(nick, iCurrentNick()) {
+		return
+	}
+
+	for _, channel := range channels {
+		iRelayMembership(channel, func(c ChannelConfig) bool { return c.RelayNicks },
+			fmt.Sprintf("%s is now known as %s", e.Nick, nick))
+	}
+}
+
+// withReason formats the optional reason for leaving a channel, e.g. " (Goodbye)"
+func withReason(args []string) string {
+	if len(args) == 0 || args[len(args)-1] == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", args[len(args)-1])
+}
@@ -0,0 +1,175 @@
+package bot
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	irc "github.com/thoj/go-ircevent"
+)
+
+// ircNickServ is who we identify with if the config doesn't say otherwise
+const ircNickServ = "NickServ"
+
+// ircNickReclaimInterval is how often we try to change back to our configured nick while we are on an alternate
+var ircNickReclaimInterval = time.Minute
+
+var (
+	// iNick holds the nick we are using, once we are registered with the server
+	iNick atomic.Value
+
+	// iNickAttempt indexes iNicks() for the nick we last tried to register with
+	iNickAttempt int32
+)
+
+// iSetupNick replaces go-ircevent's handling of unavailable nicks, which only ever appends underscores, with ours
+func iSetupNick(session *irc.Connection) {
+	session.ClearCallback("433")
+	session.ClearCallback("437")
+
+	session.AddCallback("433", iNickUnavailable)
+	session.AddCallback("436", iNickUnavailable)
+	session.AddCallback("437", iNickUnavailable)
+	session.AddCallback("NICK", iNickChange)
+}
+
+// iNicks returns the nicks we try to register with, in order of preference
+func iNicks() []string {
+	return append([]string{conf.IRC.Nick}, conf.IRC.AltNicks...)
+}
+
+// iCurrentNick returns the nick we are using, or "" if we haven't registered yet
+func iCurrentNick() string {
+	nick, _ := iNick.Load().(string)
+	return nick
+}
+
+// iResetNick starts again from our configured nick, before connecting to the server
+func iResetNick() {
+	iNick.Store("")
+	atomic.StoreInt32(&iNickAttempt, 0)
+}
+
+// iNickUnavailable tries the next alternate nick when the server refuses the one we asked for while registering
+// Once every alternate has been tried, underscores are added to the last one until the server accepts it
+// e.g. "433 * bridge :Nickname is already in use" or "436 * bridge :Nickname collision KILL"
+func iNickUnavailable(e *irc.Event) {
+	if len(e.Arguments) < 2 {
+		return
+	}
+	if atomic.LoadInt32(&iConnected) == 1 {
+		// We already have a nick, so this was an attempt to reclaim ours, which we will try again later
+		log.Debugf("Nick %s is still unavailable: %s", e.Arguments[1], e.Message())
+		return
+	}
+
+	nicks := iNicks()
+	attempt := int(atomic.AddInt32(&iNickAttempt, 1))
+	nick := ""
+	if attempt < len(nicks) {
+		nick = nicks[attempt]
+	} else {
+		nick = nicks[len(nicks)-1] + strings.Repeat("_", attempt-len(nicks)+1)
+	}
+
+	log.Warnf("Nick %s is unavailable (%s); trying %s", e.Arguments[1], e.Message(), nick)
+	iSession.SendRawf("NICK %s", nick)
+}
+
+// iNickRegistered records the nick the server registered us with, then identifies with NickServ if it is our configured
+// nick, or tries to get our configured nick back if not
+func iNickRegistered(nick string) {
+	iNick.Store(nick)
+
+	if iIsConfiguredNick(nick) {
+		iIdentify()
+		return
+	}
+
+	log.Warnf("Registered with alternate nick %s since %s is unavailable", nick, conf.IRC.Nick)
+	iRegainNick()
+}
+
+// iNickChange follows changes to our own nick, identifying with NickServ once we have our configured nick back
+func iNickChange(e *irc.Event) {
+	if !strings.EqualFold(e.Nick, iCurrentNick()) {
+		return
+	}
+
+	nick := e.Message()
+	iNick.Store(nick)
+	iRenamePrefix(nick)
+	log.Infof("Changed nick from %s to %s", e.Nick, nick)
+
+	if iIsConfiguredNick(nick) {
+		iIdentify()
+	}
+}
+
+func iIsConfiguredNick(nick string) bool {
+	return strings.EqualFold(nick, conf.IRC.Nick)
+}
+
+// iNickServ returns who to send NickServ commands to
+func iNickServ() string {
+	if conf.IRC.NickServ != "" {
+		return conf.IRC.NickServ
+	}
+	return ircNickServ
+}
+
+// iIdentify identifies with NickServ for our configured nick, unless SASL has already logged us in
+// Commands to NickServ are sent straight away rather than queued, since we may need them to join channels, but still
+// count against the global flood limit
+func iIdentify() {
+	if conf.IRC.NickServPassword == "" || iSession.UseSASL {
+		return
+	}
+
+	log.Infof("Identifying with %s as %s", iNickServ(), conf.IRC.Nick)
+	iQueue.takeGlobal()
+	iSession.Privmsgf(iNickServ(), "IDENTIFY %s %s", conf.IRC.Nick, conf.IRC.NickServPassword)
+}
+
+// iRegainNick asks NickServ to free our configured nick from whoever is using it, then changes to it
+// REGAIN does both at once, but not every network's NickServ has it; GHOST disconnects whoever is using the nick, and
+// if our NICK reaches the server before they are gone, the next periodic attempt to reclaim the nick will get it
+func iRegainNick() {
+	nick, password := conf.IRC.Nick, conf.IRC.NickServPassword
+	switch {
+	case password == "":
+	case conf.IRC.NickServRegain:
+		log.Infof("Asking %s to regain %s", iNickServ(), nick)
+		iQueue.takeGlobal()
+		iSession.Privmsgf(iNickServ(), "REGAIN %s %s", nick, password)
+		return
+	default:
+		log.Infof("Asking %s to ghost %s", iNickServ(), nick)
+		iQueue.takeGlobal()
+		iSession.Privmsgf(iNickServ(), "GHOST %s %s", nick, password)
+	}
+
+	iQueue.takeGlobal()
+	iSession.SendRawf("NICK %s", nick)
+}
+
+// iReclaimNick periodically tries to change back to our configured nick while we are on an alternate, until `quit` is
+// closed
+func iReclaimNick(quit <-chan struct{}) {
+	ticker := time.NewTicker(ircNickReclaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+
+		if nick := iCurrentNick(); nick == "" || iIsConfiguredNick(nick) {
+			continue
+		}
+		iQueueLines("", conf.IRC.Nick, []string{"NICK " + conf.IRC.Nick})
+	}
+}
@@ -0,0 +1,581 @@
+package bot
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// defaultStoreMaxMessages and defaultStoreMaxAge limit how many relayed messages are remembered, and for how long,
+	// unless configured
+	defaultStoreMaxMessages = 10000
+	defaultStoreMaxAge      = 7 * 24 * time.Hour
+
+	// storePruneInterval is how often messages past their age limit are forgotten
+	storePruneInterval = time.Hour
+)
+
+// StoreConfig represents where the bridge remembers which messages on each side are copies of each other, which is
+// what lets edits, deletions and replies be relayed
+type StoreConfig struct {
+	// Path is the file to remember them in, so that they survive restarts; if it is "", they are only kept in memory
+	Path string `json:"path"`
+
+	// MaxMessages and MaxAgeHours limit how many messages are remembered, and for how long
+	MaxMessages int `json:"max_messages"`
+	MaxAgeHours int `json:"max_age_hours"`
+}
+
+// relayedMessage correlates a message on one side of the bridge with its copy on the other
+type relayedMessage struct {
+	// FromIRC is whether the message was sent on IRC, and the Discord message is our copy of it, rather than the
+	// other way round
+	FromIRC bool `json:"from_irc"`
+
+	// Channel is the mapped "guild#channel" name of the Discord channel, and IRCChannel the IRC channel
+	Channel    string `json:"channel"`
+	IRCChannel string `json:"irc_channel"`
+
+	// DiscordChanID and DiscordID identify the Discord message, and IRCMsgID the IRC message, if the server gave it
+	// an IRCv3 msgid
+	DiscordChanID string `json:"discord_chan_id"`
+	DiscordID     string `json:"discord_id"`
+	IRCMsgID      string `json:"irc_msgid,omitempty"`
+
+	// Nick is who sent the message, as it appears on IRC, and Content what they said, as relayed
+	Nick    string    `json:"nick"`
+	Content string    `json:"content"`
+	Time    time.Time `json:"time"`
+}
+
+// messageStore remembers relayed messages, keyed by their Discord message ID, forgetting them once past its limits
+type messageStore interface {
+	// save remembers `m`, replacing any message with the same Discord message ID
+	save(m relayedMessage)
+
+	// setIRCMsgID records the IRC msgid of the message with the Discord message ID `id`, if it is remembered
+	setIRCMsgID(id, msgID string)
+
+	// setContent changes what the message with the Discord message ID `id` says, if it is remembered, returning it as
+	// it was before
+	setContent(id, content string) (relayedMessage, bool)
+
+	// byDiscordID and byIRCMsgID look up a message by its ID on either side
+	byDiscordID(id string) (relayedMessage, bool)
+	byIRCMsgID(msgID string) (relayedMessage, bool)
+
+	// lastFrom looks up the most recent message from `nick` in the mapped Discord channel `channel`, which was sent
+	// on IRC if `fromIRC`, or on Discord otherwise
+	lastFrom(channel, nick string, fromIRC bool) (relayedMessage, bool)
+
+	// remove forgets the message with the Discord message ID `id`
+	remove(id string)
+
+	// prune forgets messages past the age limit
+	prune()
+
+	close() error
+}
+
+// relayedMessages remembers the messages relayed in both directions
+var relayedMessages messageStore = newMemoryStore(defaultStoreMaxMessages, defaultStoreMaxAge, realClock{})
+
+// storeQuitting is closed to stop forgetting old messages and close the message store, and storeStopped is closed once
+// it is
+var storeQuitting, storeStopped chan struct{}
+
+// initMessageStore opens the store `c` configures, forgetting old messages from it periodically
+func initMessageStore(c StoreConfig) {
+	maxMessages := defaultStoreMaxMessages
+	if c.MaxMessages > 0 {
+		maxMessages = c.MaxMessages
+	}
+	maxAge := defaultStoreMaxAge
+	if c.MaxAgeHours > 0 {
+		maxAge = time.Duration(c.MaxAgeHours) * time.Hour
+	}
+
+	if c.Path == "" {
+		relayedMessages = newMemoryStore(maxMessages, maxAge, realClock{})
+	} else {
+		retryErrors("open message store", func() (err error) {
+			relayedMessages, err = newBoltStore(c.Path, maxMessages, maxAge, realClock{})
+			return
+		})
+	}
+
+	storeQuitting, storeStopped = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(storeStopped)
+		maintainMessageStore(relayedMessages, realClock{}, storeQuitting)
+	}()
+}
+
+// maintainMessageStore forgets old messages from `store` every storePruneInterval, until `quit` is closed, when it
+// closes the store
+func maintainMessageStore(store messageStore, clk clock, quit <-chan struct{}) {
+	for {
+		select {
+		case <-clk.After(storePruneInterval):
+			store.prune()
+		case <-quit:
+			if err := store.close(); err != nil {
+				log.Errorf("Failed to close the message store: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// closeMessageStore stops forgetting old messages and closes the message store
+func closeMessageStore() {
+	close(storeQuitting)
+	<-storeStopped
+}
+
+// memoryStore is a messageStore which forgets the least recently used messages once it holds `maxMessages`
+type memoryStore struct {
+	maxMessages int
+	maxAge      time.Duration
+	clock       clock
+
+	lock      sync.Mutex
+	lru       *list.List                 // of relayedMessage, most recently used first
+	byID      map[string]*list.Element   // by Discord message ID
+	byMsgID   map[string]string          // Discord message IDs by IRC msgid
+	fromNicks map[string]map[string]bool // sets of Discord message IDs by storeNickKey
+}
+
+func newMemoryStore(maxMessages int, maxAge time.Duration, clk clock) *memoryStore {
+	return &memoryStore{
+		maxMessages: maxMessages,
+		maxAge:      maxAge,
+		clock:       clk,
+		lru:         list.New(),
+		byID:        map[string]*list.Element{},
+		byMsgID:     map[string]string{},
+		fromNicks:   map[string]map[string]bool{},
+	}
+}
+
+// storeNickKey identifies the messages from `nick` in `channel` which were sent on IRC if `fromIRC`
+func storeNickKey(channel, nick string, fromIRC bool) string {
+	direction := "discord"
+	if fromIRC {
+		direction = "irc"
+	}
+	return direction + "\x00" + channel + "\x00" + strings.ToLower(nick)
+}
+
+func (s *memoryStore) save(m relayedMessage) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.saveLocked(m)
+}
+
+func (s *memoryStore) saveLocked(m relayedMessage) {
+	s.removeLocked(m.DiscordID)
+
+	s.byID[m.DiscordID] = s.lru.PushFront(m)
+	if m.IRCMsgID != "" {
+		s.byMsgID[m.IRCMsgID] = m.DiscordID
+	}
+	key := storeNickKey(m.Channel, m.Nick, m.FromIRC)
+	if s.fromNicks[key] == nil {
+		s.fromNicks[key] = map[string]bool{}
+	}
+	s.fromNicks[key][m.DiscordID] = true
+
+	for s.lru.Len() > s.maxMessages {
+		s.removeLocked(s.lru.Back().Value.(relayedMessage).DiscordID)
+	}
+}
+
+func (s *memoryStore) setIRCMsgID(id, msgID string) {
+	s.update(id, func(m *relayedMessage) { m.IRCMsgID = msgID })
+}
+
+func (s *memoryStore) setContent(id, content string) (relayedMessage, bool) {
+	return s.update(id, func(m *relayedMessage) { m.Content = content })
+}
+
+// update applies `change` to the message with the Discord message ID `id`, if it is remembered, returning it as it was
+// before
+func (s *memoryStore) update(id string, change func(m *relayedMessage)) (relayedMessage, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.getLocked(id)
+	if !ok {
+		return relayedMessage{}, false
+	}
+	changed := m
+	change(&changed)
+	s.saveLocked(changed)
+	return m, true
+}
+
+// getLocked returns the message with the Discord message ID `id`, marking it as used, if it is within the age limit
+func (s *memoryStore) getLocked(id string) (relayedMessage, bool) {
+	e, ok := s.byID[id]
+	if !ok {
+		return relayedMessage{}, false
+	}
+	m := e.Value.(relayedMessage)
+	if s.clock.Now().Sub(m.Time) > s.maxAge {
+		s.removeLocked(id)
+		return relayedMessage{}, false
+	}
+	s.lru.MoveToFront(e)
+	return m, true
+}
+
+func (s *memoryStore) byDiscordID(id string) (relayedMessage, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.getLocked(id)
+}
+
+func (s *memoryStore) byIRCMsgID(msgID string) (relayedMessage, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	id, ok := s.byMsgID[msgID]
+	if !ok {
+		return relayedMessage{}, false
+	}
+	return s.getLocked(id)
+}
+
+func (s *memoryStore) lastFrom(channel, nick string, fromIRC bool) (relayedMessage, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var last relayedMessage
+	found := false
+	for id := range s.fromNicks[storeNickKey(channel, nick, fromIRC)] {
+		if m, ok := s.byID[id]; ok && (!found || m.Value.(relayedMessage).Time.After(last.Time)) {
+			last, found = m.Value.(relayedMessage), true
+		}
+	}
+	if !found {
+		return relayedMessage{}, false
+	}
+	return s.getLocked(last.DiscordID)
+}
+
+func (s *memoryStore) remove(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.removeLocked(id)
+}
+
+func (s *memoryStore) removeLocked(id string) {
+	e, ok := s.byID[id]
+	if !ok {
+		return
+	}
+	m := e.Value.(relayedMessage)
+
+	s.lru.Remove(e)
+	delete(s.byID, id)
+	if m.IRCMsgID != "" && s.byMsgID[m.IRCMsgID] == id {
+		delete(s.byMsgID, m.IRCMsgID)
+	}
+	key := storeNickKey(m.Channel, m.Nick, m.FromIRC)
+	delete(s.fromNicks[key], id)
+	if len(s.fromNicks[key]) == 0 {
+		delete(s.fromNicks, key)
+	}
+}
+
+func (s *memoryStore) prune() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.clock.Now()
+	for e := s.lru.Front(); e != nil; {
+		next := e.Next()
+		if m := e.Value.(relayedMessage); now.Sub(m.Time) > s.maxAge {
+			s.removeLocked(m.DiscordID)
+		}
+		e = next
+	}
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
+
+// Buckets in a boltStore
+var (
+	// boltMessages holds each message as JSON, by Discord message ID
+	boltMessages = []byte("messages")
+
+	// boltMsgIDs holds the Discord message ID of each message by IRC msgid
+	boltMsgIDs = []byte("irc_msgids")
+
+	// boltTimes holds a key for each message made of boltTimeKey, so they can be found in the order they were sent
+	boltTimes = []byte("times")
+
+	// boltNicks holds a key for each message made of its storeNickKey and boltTimeKey, so that the most recent from a
+	// nick is the last key with its storeNickKey
+	boltNicks = []byte("nicks")
+)
+
+// boltStore is a messageStore kept in a bbolt database file, which forgets the oldest messages once it holds
+// `maxMessages`
+// The sequence of the messages bucket counts the messages in it
+type boltStore struct {
+	db          *bolt.DB
+	maxMessages int
+	maxAge      time.Duration
+	clock       clock
+}
+
+func newBoltStore(path string, maxMessages int, maxAge time.Duration, clk clock) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltMessages, boltMsgIDs, boltTimes, boltNicks} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close() // nolint: errcheck
+		return nil, err
+	}
+
+	s := &boltStore{db: db, maxMessages: maxMessages, maxAge: maxAge, clock: clk}
+	s.prune()
+	return s, nil
+}
+
+// boltTimeKey orders messages by the time they were sent, then by Discord message ID
+func boltTimeKey(m relayedMessage) []byte {
+	key := make([]byte, 8, 8+len(m.DiscordID))
+	binary.BigEndian.PutUint64(key, uint64(m.Time.UnixNano()))
+	return append(key, m.DiscordID...)
+}
+
+func boltNickKey(m relayedMessage) []byte {
+	return append([]byte(storeNickKey(m.Channel, m.Nick, m.FromIRC)+"\x00"), boltTimeKey(m)...)
+}
+
+func (s *boltStore) save(m relayedMessage) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.saveTx(tx, m)
+	})
+	if err != nil {
+		log.Errorf("Failed to save message %s to the message store: %s", m.DiscordID, err)
+	}
+}
+
+func (s *boltStore) saveTx(tx *bolt.Tx, m relayedMessage) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	if err := s.removeTx(tx, m.DiscordID); err != nil {
+		return err
+	}
+	messages := tx.Bucket(boltMessages)
+	if err := messages.Put([]byte(m.DiscordID), value); err != nil {
+		return err
+	}
+	if err := messages.SetSequence(messages.Sequence() + 1); err != nil {
+		return err
+	}
+	if m.IRCMsgID != "" {
+		if err := tx.Bucket(boltMsgIDs).Put([]byte(m.IRCMsgID), []byte(m.DiscordID)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltTimes).Put(boltTimeKey(m), nil); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltNicks).Put(boltNickKey(m), nil); err != nil {
+		return err
+	}
+
+	// Forget the oldest messages once there are too many
+	times := tx.Bucket(boltTimes).Cursor()
+	for n := int(messages.Sequence()) - s.maxMessages; n > 0; n-- {
+		key, _ := times.First()
+		if key == nil {
+			break
+		}
+		if err := s.removeTx(tx, string(key[8:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) setIRCMsgID(id, msgID string) {
+	s.update(id, func(m *relayedMessage) { m.IRCMsgID = msgID })
+}
+
+func (s *boltStore) setContent(id, content string) (relayedMessage, bool) {
+	return s.update(id, func(m *relayedMessage) { m.Content = content })
+}
+
+// update applies `change` to the message with the Discord message ID `id`, if it is remembered, returning it as it was
+// before
+func (s *boltStore) update(id string, change func(m *relayedMessage)) (m relayedMessage, ok bool) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if m, ok = s.getTx(tx, []byte(id)); !ok {
+			return nil
+		}
+		changed := m
+		change(&changed)
+		return s.saveTx(tx, changed)
+	})
+	if err != nil {
+		log.Errorf("Failed to update message %s in the message store: %s", id, err)
+		return relayedMessage{}, false
+	}
+	return m, ok
+}
+
+// getTx returns the message with the Discord message ID `id`, if it is within the age limit
+func (s *boltStore) getTx(tx *bolt.Tx, id []byte) (relayedMessage, bool) {
+	value := tx.Bucket(boltMessages).Get(id)
+	if value == nil {
+		return relayedMessage{}, false
+	}
+
+	var m relayedMessage
+	if err := json.Unmarshal(value, &m); err != nil {
+		log.Errorf("Failed to decode message %s from the message store: %s", id, err)
+		return relayedMessage{}, false
+	}
+	if s.clock.Now().Sub(m.Time) > s.maxAge {
+		return relayedMessage{}, false
+	}
+	return m, true
+}
+
+func (s *boltStore) byDiscordID(id string) (m relayedMessage, ok bool) {
+	s.view(func(tx *bolt.Tx) {
+		m, ok = s.getTx(tx, []byte(id))
+	})
+	return
+}
+
+func (s *boltStore) byIRCMsgID(msgID string) (m relayedMessage, ok bool) {
+	s.view(func(tx *bolt.Tx) {
+		if id := tx.Bucket(boltMsgIDs).Get([]byte(msgID)); id != nil {
+			m, ok = s.getTx(tx, id)
+		}
+	})
+	return
+}
+
+func (s *boltStore) lastFrom(channel, nick string, fromIRC bool) (m relayedMessage, ok bool) {
+	prefix := []byte(storeNickKey(channel, nick, fromIRC) + "\x00")
+	s.view(func(tx *bolt.Tx) {
+		c := tx.Bucket(boltNicks).Cursor()
+
+		// Find the last key with the prefix, by seeking to the first key after them all and stepping back
+		after := append([]byte{}, prefix...)
+		after[len(after)-1]++
+		key, _ := c.Seek(after)
+		if key == nil {
+			key, _ = c.Last()
+		} else {
+			key, _ = c.Prev()
+		}
+		if key != nil && bytes.HasPrefix(key, prefix) {
+			m, ok = s.getTx(tx, key[len(prefix)+8:])
+		}
+	})
+	return
+}
+
+// view runs `f` in a read-only transaction
+func (s *boltStore) view(f func(tx *bolt.Tx)) {
+	err := s.db.View(func(tx *bolt.Tx) error {
+		f(tx)
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to read from the message store: %s", err)
+	}
+}
+
+func (s *boltStore) remove(id string) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return s.removeTx(tx, id)
+	})
+	if err != nil {
+		log.Errorf("Failed to remove message %s from the message store: %s", id, err)
+	}
+}
+
+func (s *boltStore) removeTx(tx *bolt.Tx, id string) error {
+	messages := tx.Bucket(boltMessages)
+	value := messages.Get([]byte(id))
+	if value == nil {
+		return nil
+	}
+
+	var m relayedMessage
+	if err := json.Unmarshal(value, &m); err != nil {
+		return err
+	}
+
+	if m.IRCMsgID != "" && bytes.Equal(tx.Bucket(boltMsgIDs).Get([]byte(m.IRCMsgID)), []byte(id)) {
+		if err := tx.Bucket(boltMsgIDs).Delete([]byte(m.IRCMsgID)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltTimes).Delete(boltTimeKey(m)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltNicks).Delete(boltNickKey(m)); err != nil {
+		return err
+	}
+	if err := messages.Delete([]byte(id)); err != nil {
+		return err
+	}
+	return messages.SetSequence(messages.Sequence() - 1)
+}
+
+func (s *boltStore) prune() {
+	cutoff := uint64(s.clock.Now().Add(-s.maxAge).UnixNano())
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		times := tx.Bucket(boltTimes).Cursor()
+		for key, _ := times.First(); key != nil && binary.BigEndian.Uint64(key) < cutoff; key, _ = times.First() {
+			if err := s.removeTx(tx, string(key[8:])); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to forget old messages from the message store: %s", err)
+	}
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,251 @@
+package bot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMessageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "messagestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	stores := []struct {
+		name string
+		open func(clk clock) messageStore
+	}{
+		{"memory", func(clk clock) messageStore {
+			return newMemoryStore(3, time.Hour, clk)
+		}},
+		{"bolt", func(clk clock) messageStore {
+			s, err := newBoltStore(filepath.Join(dir, "messages.db"), 3, time.Hour, clk)
+			So(err, ShouldBeNil)
+			return s
+		}},
+	}
+
+	for _, store := range stores {
+		Convey("When relayed messages are kept in a "+store.name+" store", t, func() {
+			clk := newFakeClock()
+			s := store.open(clk)
+			defer func() {
+				So(s.close(), ShouldBeNil)
+				os.Remove(filepath.Join(dir, "messages.db")) // nolint: errcheck
+			}()
+
+			message := func(id, msgID, nick string, fromIRC bool) relayedMessage {
+				clk.advance(time.Minute)
+				return relayedMessage{FromIRC: fromIRC, Channel: "guild#foo", IRCChannel: "#foo", DiscordChanID: "c",
+					DiscordID: id, IRCMsgID: msgID, Nick: nick, Content: "message " + id, Time: clk.Now()}
+			}
+			one := message("d1", "m1", "someone", false)
+			two := message("d2", "", "someone", false)
+			three := message("d3", "m3", "Someone", true)
+			s.save(one)
+			s.save(two)
+			s.save(three)
+
+			Convey("They can be found by either ID", func() {
+				m, ok := s.byDiscordID("d2")
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, two)
+
+				m, ok = s.byIRCMsgID("m3")
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, three)
+
+				_, ok = s.byDiscordID("d4")
+				So(ok, ShouldBeFalse)
+				_, ok = s.byIRCMsgID("")
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("The last message from a nick in each direction can be found", func() {
+				m, ok := s.lastFrom("guild#foo", "someone", false)
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, two)
+
+				m, ok = s.lastFrom("guild#foo", "SOMEONE", true)
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, three)
+
+				_, ok = s.lastFrom("guild#bar", "someone", false)
+				So(ok, ShouldBeFalse)
+				_, ok = s.lastFrom("guild#foo", "someone else", false)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Saving a message again replaces it", func() {
+				two.IRCMsgID = "m2"
+				two.Content = "edited"
+				s.save(two)
+
+				m, ok := s.byIRCMsgID("m2")
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, two)
+
+				s.save(message("d4", "", "other", false))
+				_, ok = s.byDiscordID("d1")
+				So(ok, ShouldBeFalse)
+				_, ok = s.byDiscordID("d2")
+				So(ok, ShouldBeTrue)
+			})
+
+			Convey("A message's msgid and content can be changed in place", func() {
+				s.setIRCMsgID("d2", "m2")
+				old, ok := s.setContent("d2", "edited")
+				So(ok, ShouldBeTrue)
+				So(old.IRCMsgID, ShouldEqual, "m2")
+				So(old.Content, ShouldEqual, "message d2")
+
+				two.IRCMsgID = "m2"
+				two.Content = "edited"
+				m, ok := s.byIRCMsgID("m2")
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, two)
+
+				s.setIRCMsgID("d4", "m4")
+				_, ok = s.setContent("d4", "edited")
+				So(ok, ShouldBeFalse)
+				_, ok = s.byIRCMsgID("m4")
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("Removed messages are forgotten", func() {
+				s.remove("d2")
+				_, ok := s.byDiscordID("d2")
+				So(ok, ShouldBeFalse)
+
+				m, ok := s.lastFrom("guild#foo", "someone", false)
+				So(ok, ShouldBeTrue)
+				So(m, ShouldResemble, one)
+
+				s.remove("d1")
+				_, ok = s.byIRCMsgID("m1")
+				So(ok, ShouldBeFalse)
+				_, ok = s.lastFrom("guild#foo", "someone", false)
+				So(ok, ShouldBeFalse)
+			})
+
+			Convey("The oldest messages are forgotten once there are too many", func() {
+				s.save(message("d4", "m4", "other", false))
+				_, ok := s.byDiscordID("d1")
+				So(ok, ShouldBeFalse)
+				_, ok = s.byIRCMsgID("m1")
+				So(ok, ShouldBeFalse)
+
+				for _, id := range []string{"d2", "d3", "d4"} {
+					_, ok = s.byDiscordID(id)
+					So(ok, ShouldBeTrue)
+				}
+			})
+
+			Convey("Messages are forgotten once too old", func() {
+				clk.advance(time.Hour - time.Minute)
+				_, ok := s.byDiscordID("d1")
+				So(ok, ShouldBeFalse)
+				_, ok = s.byDiscordID("d2")
+				So(ok, ShouldBeTrue)
+
+				clk.advance(time.Hour)
+				s.prune()
+				s.save(message("d4", "", "other", false))
+				for _, id := range []string{"d1", "d2", "d3"} {
+					_, ok = s.byDiscordID(id)
+					So(ok, ShouldBeFalse)
+				}
+				_, ok = s.byDiscordID("d4")
+				So(ok, ShouldBeTrue)
+			})
+
+			if store.name == "bolt" {
+				Convey("They are remembered when the store is reopened", func() {
+					So(s.close(), ShouldBeNil)
+					s = store.open(clk)
+
+					m, ok := s.byIRCMsgID("m1")
+					So(ok, ShouldBeTrue)
+					So(m, ShouldResemble, one)
+
+					m, ok = s.lastFrom("guild#foo", "someone", true)
+					So(ok, ShouldBeTrue)
+					So(m, ShouldResemble, three)
+				})
+			}
+		})
+	}
+}
+
+// recordingStore records when a messageStore is pruned and closed
+type recordingStore struct {
+	messageStore
+	events chan string
+}
+
+func (s recordingStore) prune() {
+	s.events <- "pruned"
+}
+
+func (s recordingStore) close() error {
+	s.events <- "closed"
+	return nil
+}
+
+func TestMaintainMessageStore(t *testing.T) {
+	Convey("When the message store is maintained", t, func() {
+		clk := newFakeClock()
+		s := recordingStore{events: make(chan string, 10)}
+		quit, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			maintainMessageStore(s, clk, quit)
+		}()
+
+		Convey("Old messages are forgotten periodically", func() {
+			for i := 0; i < 2; i++ {
+				So(clk.waitForTimer(), ShouldBeTrue)
+				clk.advance(storePruneInterval)
+				So(receive(s.events), ShouldEqual, "pruned")
+			}
+			close(quit)
+			<-stopped
+		})
+
+		Convey("It closes the store and stops when told to", func() {
+			close(quit)
+			So(receive(s.events), ShouldEqual, "closed")
+			<-stopped
+
+			clk.advance(storePruneInterval)
+			So(len(s.events), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestInitMessageStore(t *testing.T) {
+	Convey("When the configured message store is closed", t, func() {
+		dir, err := ioutil.TempDir("", "messagestore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir) // nolint: errcheck
+		defer func() { relayedMessages = newMemoryStore(defaultStoreMaxMessages, defaultStoreMaxAge, realClock{}) }()
+
+		path := filepath.Join(dir, "messages.db")
+		initMessageStore(StoreConfig{Path: path})
+		relayedMessages.save(relayedMessage{Channel: "guild#foo", DiscordID: "d1", Nick: "someone", Time: time.Now()})
+		closeMessageStore()
+
+		s, err := newBoltStore(path, defaultStoreMaxMessages, defaultStoreMaxAge, realClock{})
+		So(err, ShouldBeNil)
+		defer s.close() // nolint: errcheck
+
+		_, ok := s.byDiscordID("d1")
+		So(ok, ShouldBeTrue)
+	})
+}
@@ -0,0 +1,126 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ircNetsplitWindow is how long we wait for more quits from a netsplit before summarising it
+	ircNetsplitWindow = 5 * time.Second
+
+	// ircNetsplitInterval is the least time between netsplit summaries to the same channel, so that a flapping link
+	// doesn't flood Discord
+	ircNetsplitInterval = time.Minute
+
+	// ircNetsplitMaxNicks is how many nicks a netsplit summary lists before just counting the rest
+	ircNetsplitMaxNicks = 20
+)
+
+// netsplitRegex matches the reason servers give for quits caused by a netsplit, the two servers which split
+// Servers prefix the reasons users give with "Quit: ", so users can't fake this
+var netsplitRegex = regexp.MustCompile(`^([a-zA-Z0-9-]+\.)+[a-zA-Z0-9-]+ ([a-zA-Z0-9-]+\.)+[a-zA-Z0-9-]+$`)
+
+// netsplitServers returns the servers which split if `reason` is the reason for a quit caused by a netsplit
+func netsplitServers(reason string) (string, bool) {
+	if !netsplitRegex.MatchString(reason) {
+		return "", false
+	}
+	return reason, true
+}
+
+// netsplits collects quits caused by netsplits, posting one summary for each channel instead of a line for each quit
+type netsplits struct {
+	post func(channel, message string)
+
+	lock    sync.Mutex
+	pending map[string]*netsplit
+	last    map[string]time.Time
+}
+
+// netsplit is the quits from one channel which are waiting to be summarised
+type netsplit struct {
+	servers []string
+	nicks   []string
+}
+
+func newNetsplits(post func(channel, message string)) *netsplits {
+	return &netsplits{post: post, pending: map[string]*netsplit{}, last: map[string]time.Time{}}
+}
+
+// iNetsplits collects netsplit quits from IRC for mapped Discord channels
+var iNetsplits = newNetsplits(func(channel, message string) { ircMembershipNotice(channel, message) })
+
+// add records `nick` quitting `channel` because `servers` split
+// The summary is posted once no more quits are expected, or later if a summary was posted to the channel recently
+func (n *netsplits) add(channel, servers, nick string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if split, ok := n.pending[channel]; ok {
+		split.nicks = append(split.nicks, nick)
+		if !containsString(split.servers, servers) {
+			split.servers = append(split.servers, servers)
+		}
+		return
+	}
+
+	n.pending[channel] = &netsplit{servers: []string{servers}, nicks: []string{nick}}
+
+	delay := ircNetsplitWindow
+	if last, ok := n.last[channel]; ok {
+		if wait := time.Until(last.Add(ircNetsplitInterval)); wait > delay {
+			delay = wait
+		}
+	}
+	time.AfterFunc(delay, func() { n.flush(channel) })
+}
+
+// flush posts the summary of the quits from `channel`
+func (n *netsplits) flush(channel string) {
+	n.lock.Lock()
+	split := n.pending[channel]
+	delete(n.pending, channel)
+	n.last[channel] = time.Now()
+	n.lock.Unlock()
+
+	if split != nil {
+		n.post(channel, split.summary())
+	}
+}
+
+// summary describes the quits, e.g. "Netsplit between a.example.com and b.example.com: foo, bar and baz have quit"
+func (s *netsplit) summary() string {
+	servers := make([]string, len(s.servers))
+	for i, pair := range s.servers {
+		servers[i] = strings.Replace(pair, " ", " and ", 1)
+	}
+
+	nicks := s.nicks
+	more := ""
+	if len(nicks) > ircNetsplitMaxNicks {
+		more = fmt.Sprintf(" and %d more", len(nicks)-ircNetsplitMaxNicks)
+		nicks = nicks[:ircNetsplitMaxNicks]
+	} else if len(nicks) > 1 {
+		more = " and " + nicks[len(nicks)-1]
+		nicks = nicks[:len(nicks)-1]
+	}
+
+	verb := "has"
+	if len(s.nicks) > 1 {
+		verb = "have"
+	}
+	return fmt.Sprintf("Netsplit between %s: %s%s %s quit", strings.Join(servers, ", "), strings.Join(nicks, ", "), more, verb)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
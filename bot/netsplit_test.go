@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNetsplitServers(t *testing.T) {
+	tests := []struct {
+		reason  string
+		servers string
+		ok      bool
+	}{
+		{"hub.example.net leaf.example.net", "hub.example.net leaf.example.net", true},
+		{"*.net *.split", "", false},
+		{"Quit: hub.example.net leaf.example.net", "", false},
+		{"Ping timeout: 240 seconds", "", false},
+		{"hub.example.net", "", false},
+	}
+
+	Convey("When quit reasons are checked for netsplits", t, func() {
+		for _, test := range tests {
+			servers, ok := netsplitServers(test.reason)
+			So(ok, ShouldEqual, test.ok)
+			So(servers, ShouldEqual, test.servers)
+		}
+	})
+}
+
+func TestNetsplitSummary(t *testing.T) {
+	max := ircNetsplitMaxNicks
+	ircNetsplitMaxNicks = 3
+	defer func() { ircNetsplitMaxNicks = max }()
+
+	tests := []struct {
+		split   netsplit
+		summary string
+	}{
+		{
+			netsplit{servers: []string{"a.net b.net"}, nicks: []string{"foo"}},
+			"Netsplit between a.net and b.net: foo has quit",
+		},
+		{
+			netsplit{servers: []string{"a.net b.net"}, nicks: []string{"foo", "bar", "baz"}},
+			"Netsplit between a.net and b.net: foo, bar and baz have quit",
+		},
+		{
+			netsplit{servers: []string{"a.net b.net", "a.net c.net"}, nicks: []string{"foo", "bar", "baz", "qux", "quux"}},
+			"Netsplit between a.net and b.net, a.net and c.net: foo, bar, baz and 2 more have quit",
+		},
+	}
+
+	Convey("When netsplits are summarised", t, func() {
+		for _, test := range tests {
+			So(test.split.summary(), ShouldEqual, test.summary)
+		}
+	})
+}
+
+func TestNetsplits(t *testing.T) {
+	window, interval := ircNetsplitWindow, ircNetsplitInterval
+	ircNetsplitWindow, ircNetsplitInterval = 20*time.Millisecond, 200*time.Millisecond
+	defer func() { ircNetsplitWindow, ircNetsplitInterval = window, interval }()
+
+	Convey("When many users quit in a netsplit", t, func() {
+		posted := make(chan string, 10)
+		n := newNetsplits(func(channel, message string) { posted <- channel + " " + message })
+
+		n.add("#foo", "a.net b.net", "one")
+		n.add("#bar", "a.net b.net", "one")
+		n.add("#foo", "a.net b.net", "two")
+
+		Convey("Each channel gets one summary", func() {
+			summaries := []string{receive(posted), receive(posted)}
+			So(summaries, ShouldContain, "#foo Netsplit between a.net and b.net: one and two have quit")
+			So(summaries, ShouldContain, "#bar Netsplit between a.net and b.net: one has quit")
+		})
+
+		Convey("Summaries to the same channel are rate limited", func() {
+			receive(posted)
+			receive(posted)
+
+			start := time.Now()
+			n.add("#foo", "a.net b.net", "three")
+			n.add("#foo", "a.net b.net", "four")
+			So(receive(posted), ShouldEqual, "#foo Netsplit between a.net and b.net: three and four have quit")
+			So(time.Since(start), ShouldBeGreaterThan, 100*time.Millisecond)
+		})
+	})
+}
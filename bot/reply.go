@@ -0,0 +1,152 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	discord "github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/GinjaNinja32/DisGoIRC/format"
+)
+
+const (
+	// dMessageTypeReply is the type of Discord messages which reply to another, which discordgo doesn't name
+	dMessageTypeReply discord.MessageType = 19
+
+	// replyExcerptLength is how many characters of the message replied to are quoted on IRC
+	replyExcerptLength = 40
+)
+
+// dReply is the part of a Discord message which says what it replies to, which discordgo doesn't decode
+type dReply struct {
+	MessageReference *struct {
+		MessageID string `json:"message_id"`
+	} `json:"message_reference"`
+
+	// ReferencedMessage is the message replied to, or nil if it has been deleted
+	ReferencedMessage *discord.Message `json:"referenced_message"`
+}
+
+// dMessageCreateEvent handles a new Discord message from its raw gateway event, which still has what it replies to
+func dMessageCreateEvent(s *discord.Session, e *discord.Event) {
+	m, ok := e.Struct.(*discord.MessageCreate)
+	if !ok {
+		return
+	}
+
+	var reply dReply
+	if m.Type == dMessageTypeReply {
+		if err := json.Unmarshal(e.RawData, &reply); err != nil {
+			log.Errorf("Failed to decode the reference of reply %s: %s", m.ID, err)
+		}
+	}
+	dMessageCreate(s, m, reply)
+}
+
+// dReplyContext returns the context relaying a reply to IRC, naming who it replies to and quoting the start of what
+// they said, or "" if the message isn't a reply or what it replies to is unknown
+// Discord names are kept from highlighting IRC users with the same nick, but IRC nicks are left to highlight whoever
+// was replied to
+func dReplyContext(g *discord.Guild, reply dReply) string {
+	if reply.MessageReference == nil {
+		return ""
+	}
+
+	if relayed, ok := relayedMessages.byDiscordID(reply.MessageReference.MessageID); ok {
+		if relayed.FromIRC {
+			return ircReplyContext(relayed.Nick, relayed.Content)
+		}
+		return ircReplyContext(iAddAntiPing(relayed.Nick), format.ParseDiscord(relayed.Content).RenderPlain())
+	}
+
+	if m := reply.ReferencedMessage; m != nil && m.Author != nil {
+		nick := iAddAntiPing(getDisplayNameForUser(m.Author, g.Members))
+		return ircReplyContext(nick, format.ParseDiscord(convertMentionsForIRC(g, m)).RenderPlain())
+	}
+	return ""
+}
+
+// ircReplyContext returns the context relaying a reply to `nick`, who said `content`, to IRC
+// e.g. `re nick: "the start of what they said…"`
+func ircReplyContext(nick, content string) string {
+	excerpt := strings.Join(strings.Fields(content), " ")
+	if utf8.RuneCountInString(excerpt) > replyExcerptLength {
+		excerpt = strings.TrimSpace(string([]rune(excerpt)[:replyExcerptLength-1])) + "…"
+	}
+
+	if excerpt == "" {
+		return "re " + nick
+	}
+	return fmt.Sprintf("re %s: \"%s\"", nick, excerpt)
+}
+
+// withReplyContext returns a reply `fs` as relayed to IRC, with its context from dReplyContext, if any, before it
+func withReplyContext(context string, fs format.FormattedString) format.FormattedString {
+	switch {
+	case context == "":
+		return fs
+	case len(fs) == 0:
+		return format.FormattedString{{Text: context}}
+	}
+	return append(format.FormattedString{{Text: context + ": "}}, fs...)
+}
+
+// ircAddressRegex matches an IRC message addressed to someone, e.g. "nick: message" or "nick, message"
+var ircAddressRegex = regexp.MustCompile(`^([^\s:,]+)[:,]\s+(\S.*)$`)
+
+// ircReplyTarget finds the message an IRC message in a mapped channel replies to, if it is addressed to someone whose
+// last message in the mapped Discord channel `discordChan` can be found, returning it and the message without the
+// address
+func ircReplyTarget(discordChan, message string) (relayedMessage, string, bool) {
+	match := ircAddressRegex.FindStringSubmatch(message)
+	if match == nil {
+		return relayedMessage{}, "", false
+	}
+
+	// Discord names may have been copied from IRC with the character keeping them from highlighting anyone
+	nick := strings.Replace(match[1], "\ufeff", "", -1)
+
+	fromDiscord, okDiscord := relayedMessages.lastFrom(discordChan, nick, false)
+	fromIRC, okIRC := relayedMessages.lastFrom(discordChan, nick, true)
+	switch {
+	case okDiscord && (!okIRC || fromDiscord.Time.After(fromIRC.Time)):
+		return fromDiscord, match[2], true
+	case okIRC:
+		return fromIRC, match[2], true
+	}
+	return relayedMessage{}, "", false
+}
+
+// dSendMessage posts `message` to the Discord channel `chanID`, as a reply to the message with ID `replyTo` unless it
+// is "", which discordgo can't do; if that message has been deleted, it is posted as an ordinary message
+// If the message was posted but can't be decoded, it is returned without its ID, so it isn't posted again
+func dSendMessage(chanID, message, replyTo string) (*discord.Message, error) {
+	if replyTo == "" {
+		return dSession.ChannelMessageSend(chanID, message)
+	}
+
+	data := struct {
+		Content          string `json:"content"`
+		MessageReference struct {
+			MessageID       string `json:"message_id"`
+			FailIfNotExists bool   `json:"fail_if_not_exists"`
+		} `json:"message_reference"`
+	}{Content: message}
+	data.MessageReference.MessageID = replyTo
+
+	body, err := dSession.RequestWithBucketID("POST", discord.EndpointChannelMessages(chanID), data,
+		discord.EndpointChannelMessages(chanID))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &discord.Message{}
+	if err := json.Unmarshal(body, m); err != nil {
+		log.Errorf("Failed to decode the reply posted to %s: %s", chanID, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,112 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIRCReplyContext(t *testing.T) {
+	tests := []struct {
+		nick, content string
+		context       string
+	}{
+		{"bob", "hello there", `re bob: "hello there"`},
+		{"bob", "hello\n  there ", `re bob: "hello there"`},
+		{"bob", "the quick brown fox jumps over the lazy dog", `re bob: "the quick brown fox jumps over the lazy…"`},
+		{"bob", "", "re bob"},
+		{"bob", "2*3 is 6", `re bob: "2*3 is 6"`},
+	}
+
+	Convey("When replies are relayed to IRC", t, func() {
+		for _, test := range tests {
+			Convey(fmt.Sprintf("%q quoting %q", test.nick, test.content), func() {
+				So(ircReplyContext(test.nick, test.content), ShouldEqual, test.context)
+			})
+		}
+	})
+}
+
+func TestDReplyContext(t *testing.T) {
+	Convey("When a Discord message replies to another", t, func() {
+		conf = Config{}
+		relayedMessages = newMemoryStore(defaultStoreMaxMessages, defaultStoreMaxAge, realClock{})
+		relayedMessages.save(relayedMessage{Channel: "guild#foo", DiscordID: "d1", Nick: "bob", Content: "**hi** all",
+			Time: time.Now()})
+		relayedMessages.save(relayedMessage{FromIRC: true, Channel: "guild#foo", DiscordID: "d2", Nick: "carol",
+			Content: "hello", Time: time.Now()})
+		g := &discord.Guild{}
+
+		reply := func(raw string) dReply {
+			var r dReply
+			So(json.Unmarshal([]byte(raw), &r), ShouldBeNil)
+			return r
+		}
+
+		Convey("A relayed Discord message is quoted without highlighting anyone on IRC", func() {
+			context := dReplyContext(g, reply(`{"message_reference": {"message_id": "d1"}}`))
+			So(context, ShouldEqual, "re b\ufeffob: \"hi all\"")
+		})
+
+		Convey("A relayed IRC message is quoted, highlighting its sender", func() {
+			context := dReplyContext(g, reply(`{"message_reference": {"message_id": "d2"}}`))
+			So(context, ShouldEqual, `re carol: "hello"`)
+		})
+
+		Convey("Other messages are quoted from the reply", func() {
+			context := dReplyContext(g, reply(`{"message_reference": {"message_id": "d3"},
+				"referenced_message": {"id": "d3", "content": "an older message", "author": {"username": "dave"}}}`))
+			So(context, ShouldEqual, "re d\ufeffave: \"an older message\"")
+		})
+
+		Convey("Nothing is quoted if the message isn't known", func() {
+			So(dReplyContext(g, reply(`{"message_reference": {"message_id": "d3"}, "referenced_message": null}`)), ShouldEqual, "")
+			So(dReplyContext(g, reply(`{}`)), ShouldEqual, "")
+		})
+	})
+}
+
+func TestIRCReplyTarget(t *testing.T) {
+	Convey("When an IRC message is addressed to someone", t, func() {
+		relayedMessages = newMemoryStore(defaultStoreMaxMessages, defaultStoreMaxAge, realClock{})
+		now := time.Now()
+		relayedMessages.save(relayedMessage{Channel: "guild#foo", DiscordID: "d1", Nick: "bob", Time: now.Add(-time.Minute)})
+		relayedMessages.save(relayedMessage{Channel: "guild#foo", DiscordID: "d2", Nick: "bob", Time: now})
+		relayedMessages.save(relayedMessage{Channel: "guild#foo", DiscordID: "d3", Nick: "carol", Time: now})
+		relayedMessages.save(relayedMessage{FromIRC: true, Channel: "guild#foo", DiscordID: "d4", Nick: "carol",
+			Time: now.Add(time.Minute)})
+
+		tests := []struct {
+			message  string
+			targetID string
+			rest     string
+			ok       bool
+		}{
+			{"bob: hello", "d2", "hello", true},
+			{"Bob, hello there", "d2", "hello there", true},
+			{"b\ufeffob: hello", "d2", "hello", true},
+			{"carol: hi", "d4", "hi", true},
+			{"bob:hello", "", "", false},
+			{"bob: ", "", "", false},
+			{"dave: hello", "", "", false},
+			{"hello bob", "", "", false},
+		}
+		for _, test := range tests {
+			Convey(fmt.Sprintf("%q", test.message), func() {
+				target, rest, ok := ircReplyTarget("guild#foo", test.message)
+				So(ok, ShouldEqual, test.ok)
+				So(target.DiscordID, ShouldEqual, test.targetID)
+				So(rest, ShouldEqual, test.rest)
+			})
+		}
+
+		Convey("Only messages in the same channel are replied to", func() {
+			_, _, ok := ircReplyTarget("guild#bar", "bob: hello")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
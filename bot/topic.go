@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Directions a mapping's topic can be synchronised in, for ChannelConfig.TopicSync
+const (
+	topicSyncNone      = ""
+	topicSyncToDiscord = "to_discord"
+	topicSyncToIRC     = "to_irc"
+	topicSyncBoth      = "both"
+)
+
+// discordMaxTopicLength is the most characters Discord allows in a channel topic
+const discordMaxTopicLength = 1024
+
+// topicSync tracks the topic last synchronised for each mapping, keyed by IRC channel
+// Setting a topic on one side is echoed back to us as a change from that side; the echo matches the synchronised topic,
+// so it isn't sent back again, which would loop forever if the two sides disagreed on how to represent it
+type topicSync struct {
+	lock   sync.Mutex
+	synced map[string]string
+	toIRC  map[string]bool // whether the synchronised topic came from Discord, so IRC may have shortened it
+}
+
+func newTopicSync() *topicSync {
+	return &topicSync{synced: map[string]string{}, toIRC: map[string]bool{}}
+}
+
+// iTopics tracks topic synchronisation for every mapping
+var iTopics = newTopicSync()
+
+// update records `topic` as the topic of `channel`, returning whether it changed
+// Topics are compared as they would be sent to IRC, since whitespace may not survive the trip to IRC and back
+func (t *topicSync) update(channel, topic string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.updateLocked(channel, topic)
+}
+
+func (t *topicSync) updateLocked(channel, topic string) bool {
+	topic = topicForIRC(topic)
+	if synced, ok := t.synced[channel]; ok && synced == topic {
+		return false
+	}
+	t.synced[channel] = topic
+	return true
+}
+
+// fromDiscord records `topic`, from Discord, as the topic of `channel`, returning whether it changed
+func (t *topicSync) fromDiscord(channel, topic string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.updateLocked(channel, topic) {
+		return false
+	}
+	t.toIRC[channel] = true
+	return true
+}
+
+// fromIRC records `topic`, from IRC, as the topic of `channel`, returning whether it changed
+// A topic which is only the start of the one last sent from Discord is that topic as the server shortened it, so it
+// doesn't replace it
+func (t *topicSync) fromIRC(channel, topic string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	shortened := topicForIRC(trimPartialRune(topic))
+	if t.toIRC[channel] && shortened != "" && strings.HasPrefix(t.synced[channel], shortened) {
+		return false
+	}
+	if !t.updateLocked(channel, topic) {
+		return false
+	}
+	t.toIRC[channel] = false
+	return true
+}
+
+// checkTopicSync checks a mapping's TopicSync setting, which must be one of the directions
+func checkTopicSync(channel string, c ChannelConfig) {
+	switch c.TopicSync {
+	case topicSyncNone, topicSyncToDiscord, topicSyncToIRC, topicSyncBoth:
+	default:
+		log.Fatalf("Unsupported topic_sync %q for %s; use %q, %q or %q",
+			c.TopicSync, channel, topicSyncToDiscord, topicSyncToIRC, topicSyncBoth)
+	}
+}
+
+// syncsTopicToDiscord returns whether IRC topic changes are mirrored to Discord for a mapping
+func (c ChannelConfig) syncsTopicToDiscord() bool {
+	return c.TopicSync == topicSyncToDiscord || c.TopicSync == topicSyncBoth
+}
+
+// syncsTopicToIRC returns whether Discord topic changes are pushed back to IRC for a mapping
+func (c ChannelConfig) syncsTopicToIRC() bool {
+	return c.TopicSync == topicSyncToIRC || c.TopicSync == topicSyncBoth
+}
+
+// topicForDiscord converts an IRC topic, which has already had its formatting removed, to fit a Discord channel topic
+func topicForDiscord(topic string) string {
+	if runes := []rune(topic); len(runes) > discordMaxTopicLength {
+		return string(runes[:discordMaxTopicLength])
+	}
+	return topic
+}
+
+// topicForIRC converts a Discord channel topic to fit an IRC topic, which can't contain line breaks
+func topicForIRC(topic string) string {
+	return strings.Join(strings.Fields(topic), " ")
+}
+
+// truncateTopic shortens an IRC topic to at most `length` bytes, without splitting a character
+func truncateTopic(topic string, length int) string {
+	if len(topic) <= length {
+		return topic
+	}
+	for length > 0 && !utf8.RuneStart(topic[length]) {
+		length--
+	}
+	return topic[:length]
+}
+
+// trimPartialRune removes the incomplete character left at the end of `s` by cutting it short at a byte limit, if any
+func trimPartialRune(s string) string {
+	for i := 0; i < utf8.UTFMax-1 && s != ""; i++ {
+		if r, size := utf8.DecodeLastRuneInString(s); r != utf8.RuneError || size != 1 {
+			break
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTopicSync(t *testing.T) {
+	Convey("When topics are synchronised", t, func() {
+		topics := newTopicSync()
+
+		Convey("Only changes are synchronised", func() {
+			So(topics.update("#foo", "a topic"), ShouldBeTrue)
+			So(topics.update("#foo", "a topic"), ShouldBeFalse)
+			So(topics.update("#bar", "a topic"), ShouldBeTrue)
+			So(topics.update("#foo", "another topic"), ShouldBeTrue)
+			So(topics.update("#foo", ""), ShouldBeTrue)
+			So(topics.update("#foo", ""), ShouldBeFalse)
+		})
+
+		Convey("Whitespace which IRC can't keep is ignored", func() {
+			So(topics.update("#foo", "a\n  topic "), ShouldBeTrue)
+			So(topics.update("#foo", "a topic"), ShouldBeFalse)
+		})
+
+		Convey("A topic from Discord which IRC shortened isn't synchronised back", func() {
+			So(topics.fromDiscord("#foo", "a long topic ✓"), ShouldBeTrue)
+			So(topics.fromIRC("#foo", "a long"), ShouldBeFalse)
+			So(topics.fromIRC("#foo", "a long topic \xe2\x9c"), ShouldBeFalse)
+			So(topics.fromDiscord("#foo", "a long topic ✓"), ShouldBeFalse)
+
+			So(topics.fromIRC("#foo", "another topic"), ShouldBeTrue)
+			So(topics.fromIRC("#foo", "another"), ShouldBeTrue)
+		})
+	})
+
+	Convey("When topics are converted", t, func() {
+		So(topicForIRC("line one\nline  two\n"), ShouldEqual, "line one line two")
+		So(topicForDiscord(strings.Repeat("é", 1030)), ShouldEqual, strings.Repeat("é", 1024))
+		So(topicForDiscord("short"), ShouldEqual, "short")
+		So(truncateTopic("short", 10), ShouldEqual, "short")
+		So(truncateTopic("a ✓ topic", 4), ShouldEqual, "a ")
+		So(truncateTopic("a ✓ topic", 5), ShouldEqual, "a ✓")
+		So(trimPartialRune("a \xe2\x9c"), ShouldEqual, "a ")
+		So(trimPartialRune("a ✓"), ShouldEqual, "a ✓")
+	})
+
+	Convey("When directions are configured", t, func() {
+		tests := []struct {
+			sync      string
+			toDiscord bool
+			toIRC     bool
+		}{
+			{"", false, false},
+			{"to_discord", true, false},
+			{"to_irc", false, true},
+			{"both", true, true},
+		}
+		for _, test := range tests {
+			c := ChannelConfig{TopicSync: test.sync}
+			So(c.syncsTopicToDiscord(), ShouldEqual, test.toDiscord)
+			So(c.syncsTopicToIRC(), ShouldEqual, test.toIRC)
+		}
+	})
+}
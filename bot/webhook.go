@@ -0,0 +1,243 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	discord "github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// dWebhookName is the name of the webhooks we create, and how we find them again after restarting
+	dWebhookName = "DisGoIRC"
+
+	// dDefaultWebhookAvatarURL generates an avatar for each nick from the SHA-256 of its lowercased form
+	dDefaultWebhookAvatarURL = "https://www.gravatar.com/avatar/%s?d=identicon&f=y&s=128"
+
+	// dMaxWebhookUsernameLength is the most characters Discord allows in a webhook's username
+	dMaxWebhookUsernameLength = 80
+)
+
+// dWebhookRetryInterval is how long we post to a channel with the bot after failing to get a webhook for it, before
+// trying again, e.g. in case we have since been given permission to manage webhooks
+var dWebhookRetryInterval = 10 * time.Minute
+
+// webhookAPI is the part of the Discord API used to post through webhooks
+type webhookAPI interface {
+	ChannelWebhooks(channelID string) ([]*discord.Webhook, error)
+	WebhookCreate(channelID, name, avatar string) (*discord.Webhook, error)
+	WebhookExecuteMessage(webhookID, token string, data *discord.WebhookParams) (*discord.Message, error)
+}
+
+// dWebhookSession is the webhook API of a Discord session
+type dWebhookSession struct {
+	*discord.Session
+}
+
+// WebhookExecuteMessage posts through a webhook, returning the message posted, which discordgo's WebhookExecute doesn't
+// If the message was posted but can't be decoded, it is returned without its ID, so it isn't posted again
+func (s dWebhookSession) WebhookExecuteMessage(webhookID, token string, data *discord.WebhookParams) (*discord.Message, error) {
+	body, err := s.RequestWithBucketID("POST", discord.EndpointWebhookToken(webhookID, token)+"?wait=true", data,
+		discord.EndpointWebhookToken("", ""))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &discord.Message{}
+	if err := json.Unmarshal(body, m); err != nil {
+		log.Errorf("Failed to decode the message posted through webhook %s: %s", webhookID, err)
+	}
+	return m, nil
+}
+
+// webhooks posts messages from IRC to Discord through a webhook in each channel, as each nick, creating the webhooks
+// as needed, or reusing ours if they already exist
+type webhooks struct {
+	api   webhookAPI
+	clock clock
+
+	lock    sync.Mutex
+	hooks   map[string]*discord.Webhook // by channel ID
+	failed  map[string]time.Time        // when we last failed to get a webhook, by channel ID
+	ours    map[string]bool             // IDs of our webhooks
+	finding map[string]*sync.Mutex      // held while finding or creating the webhook for each channel, by channel ID
+}
+
+func newWebhooks(api webhookAPI, clk clock) *webhooks {
+	return &webhooks{
+		api:     api,
+		clock:   clk,
+		hooks:   map[string]*discord.Webhook{},
+		failed:  map[string]time.Time{},
+		ours:    map[string]bool{},
+		finding: map[string]*sync.Mutex{},
+	}
+}
+
+// dWebhooks posts to mapped Discord channels which are set to use webhooks
+var dWebhooks *webhooks
+
+// isOurs returns whether messages from the webhook with ID `webhookID` were posted by us
+func (w *webhooks) isOurs(webhookID string) bool {
+	if webhookID == "" {
+		return false
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.ours[webhookID]
+}
+
+// get returns our webhook for a channel, finding or creating it if we don't have it yet, or nil if we can't
+// Only one webhook is looked for in each channel at once, so we don't create two, but the lock on everything else isn't
+// held while asking Discord
+func (w *webhooks) get(chanID string) *discord.Webhook {
+	finding := w.findingLock(chanID)
+	finding.Lock()
+	defer finding.Unlock()
+
+	if hook, known := w.known(chanID); known {
+		return hook
+	}
+
+	hook, err := w.find(chanID)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err != nil {
+		if isMissingPermissions(err) {
+			log.Warnf("Not allowed to manage webhooks in %s; posting as the bot instead", chanID)
+		} else {
+			log.Errorf("Failed to get a webhook for %s; posting as the bot instead: %s", chanID, err)
+		}
+		w.failed[chanID] = w.clock.Now()
+		return nil
+	}
+
+	delete(w.failed, chanID)
+	w.hooks[chanID] = hook
+	w.ours[hook.ID] = true
+	return hook
+}
+
+// findingLock returns the lock held while finding the webhook for a channel
+func (w *webhooks) findingLock(chanID string) *sync.Mutex {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	finding, ok := w.finding[chanID]
+	if !ok {
+		finding = &sync.Mutex{}
+		w.finding[chanID] = finding
+	}
+	return finding
+}
+
+// known returns our webhook for a channel if we have it, or nil if we failed to get it too recently to try again, and
+// whether either is the case
+func (w *webhooks) known(chanID string) (*discord.Webhook, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if hook, ok := w.hooks[chanID]; ok {
+		return hook, true
+	}
+	if failed, ok := w.failed[chanID]; ok && w.clock.Now().Sub(failed) < dWebhookRetryInterval {
+		return nil, true
+	}
+	return nil, false
+}
+
+// find returns our webhook for a channel, creating it if it doesn't exist
+func (w *webhooks) find(chanID string) (*discord.Webhook, error) {
+	hooks, err := w.api.ChannelWebhooks(chanID)
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		if hook.Name == dWebhookName && hook.Token != "" {
+			return hook, nil
+		}
+	}
+
+	log.Infof("Creating a webhook for %s", chanID)
+	return w.api.WebhookCreate(chanID, dWebhookName, "")
+}
+
+// send posts `message` to a channel as `nick`, returning the ID of the message posted and whether it did
+// If it didn't, the message should be posted as the bot instead
+func (w *webhooks) send(chanID, nick, message string) (string, bool) {
+	hook := w.get(chanID)
+	if hook == nil {
+		return "", false
+	}
+
+	m, err := w.api.WebhookExecuteMessage(hook.ID, hook.Token, &discord.WebhookParams{
+		Content:   message,
+		Username:  webhookUsername(nick),
+		AvatarURL: webhookAvatarURL(nick),
+	})
+	if err == nil {
+		return m.ID, true
+	}
+
+	log.Errorf("Failed to post to %s through its webhook; posting as the bot instead: %s", chanID, err)
+
+	// The webhook may have been deleted, so look for it again next time
+	w.lock.Lock()
+	delete(w.hooks, chanID)
+	w.lock.Unlock()
+	return "", false
+}
+
+// webhookForbiddenRegex matches the words Discord refuses in webhook usernames
+var webhookForbiddenRegex = regexp.MustCompile(`(?i)(d)(iscord)|(c)(lyde)`)
+
+// webhookUsername returns the webhook username to post as `nick` with
+// Discord refuses some words in usernames, so those have a zero-width space added to them
+func webhookUsername(nick string) string {
+	name := webhookForbiddenRegex.ReplaceAllString(nick, "$1$3\u200b$2$4")
+	if runes := []rune(name); len(runes) > dMaxWebhookUsernameLength {
+		name = string(runes[:dMaxWebhookUsernameLength])
+	}
+	return name
+}
+
+// checkWebhookAvatarURL warns about a configured webhook_avatar_url that doesn't have exactly one %s for the hash of
+// the nick, and falls back to the default avatars
+func checkWebhookAvatarURL() {
+	template := conf.Discord.WebhookAvatarURL
+	if template == "" {
+		return
+	}
+	if strings.Count(template, "%s") != 1 || strings.Contains(fmt.Sprintf(template, ""), "%!") {
+		log.Warnf("Unsupported webhook_avatar_url %q; it needs exactly one %%s and no other verbs, so using the default",
+			template)
+		conf.Discord.WebhookAvatarURL = ""
+	}
+}
+
+// webhookAvatarURL returns the avatar to post as `nick` with, which is generated from the nick, so it is always the same
+func webhookAvatarURL(nick string) string {
+	template := conf.Discord.WebhookAvatarURL
+	if template == "" {
+		template = dDefaultWebhookAvatarURL
+	}
+
+	hash := sha256.Sum256([]byte(strings.ToLower(nick)))
+	return fmt.Sprintf(template, hex.EncodeToString(hash[:]))
+}
+
+// dUsesWebhooks returns whether IRC messages are posted to the mapped Discord channel `channel` through a webhook
+func dUsesWebhooks(channel string) bool {
+	return dWebhooks != nil && channelConfigs[strings.ToLower(inverseMapping[channel])].Webhooks
+}
@@ -0,0 +1,183 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	discord "github.com/bwmarrin/discordgo"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// fakeWebhookAPI records what is done with the Discord webhook API
+type fakeWebhookAPI struct {
+	hooks      map[string][]*discord.Webhook
+	forbidden  bool
+	executeErr error
+
+	// finding, if not nil, is told each time webhooks are looked for, and replies when the lookup should finish
+	finding chan chan struct{}
+
+	created  []string
+	executed []discord.WebhookParams
+}
+
+var errMissingPermissions = &discord.RESTError{Message: &discord.APIErrorMessage{Code: discord.ErrCodeMissingPermissions}}
+
+func (f *fakeWebhookAPI) ChannelWebhooks(channelID string) ([]*discord.Webhook, error) {
+	if f.finding != nil {
+		release := make(chan struct{})
+		f.finding <- release
+		<-release
+	}
+	if f.forbidden {
+		return nil, errMissingPermissions
+	}
+	return f.hooks[channelID], nil
+}
+
+func (f *fakeWebhookAPI) WebhookCreate(channelID, name, avatar string) (*discord.Webhook, error) {
+	hook := &discord.Webhook{ID: "created-" + channelID, ChannelID: channelID, Name: name, Token: "token"}
+	f.created = append(f.created, channelID)
+	f.hooks[channelID] = append(f.hooks[channelID], hook)
+	return hook, nil
+}
+
+func (f *fakeWebhookAPI) WebhookExecuteMessage(webhookID, token string, data *discord.WebhookParams) (*discord.Message, error) {
+	if f.executeErr != nil {
+		return nil, f.executeErr
+	}
+	params := *data
+	params.Content = webhookID + " " + params.Content
+	f.executed = append(f.executed, params)
+	return &discord.Message{ID: fmt.Sprintf("message-%d", len(f.executed))}, nil
+}
+
+func TestWebhooks(t *testing.T) {
+	Convey("When IRC messages are posted through webhooks", t, func() {
+		conf = Config{}
+		api := &fakeWebhookAPI{hooks: map[string][]*discord.Webhook{
+			"existing": {
+				{ID: "someone-elses", Name: "Other bot", Token: "token"},
+				{ID: "ours", Name: "DisGoIRC", Token: "token"},
+			},
+		}}
+		clk := newFakeClock()
+		w := newWebhooks(api, clk)
+		sent := func(chanID, nick, message string) bool {
+			_, ok := w.send(chanID, nick, message)
+			return ok
+		}
+
+		Convey("Our existing webhook is reused", func() {
+			id, ok := w.send("existing", "someone", "hello")
+			So(ok, ShouldBeTrue)
+			So(id, ShouldEqual, "message-1")
+			So(sent("existing", "other", "hi"), ShouldBeTrue)
+			So(api.created, ShouldBeEmpty)
+			So(api.executed[0].Content, ShouldEqual, "ours hello")
+			So(api.executed[0].Username, ShouldEqual, "someone")
+			So(api.executed[1].Content, ShouldEqual, "ours hi")
+			So(api.executed[1].Username, ShouldEqual, "other")
+			So(w.isOurs("ours"), ShouldBeTrue)
+			So(w.isOurs("someone-elses"), ShouldBeFalse)
+		})
+
+		Convey("A webhook is created once if there isn't one", func() {
+			So(sent("new", "someone", "hello"), ShouldBeTrue)
+			So(sent("new", "someone", "again"), ShouldBeTrue)
+			So(api.created, ShouldResemble, []string{"new"})
+			So(api.executed[1].Content, ShouldEqual, "created-new again")
+			So(w.isOurs("created-new"), ShouldBeTrue)
+		})
+
+		Convey("Other channels aren't held up while a webhook is looked for", func() {
+			So(sent("existing", "someone", "hello"), ShouldBeTrue)
+
+			api.finding = make(chan chan struct{})
+			done := make(chan bool)
+			go func() { done <- sent("new", "someone", "hello") }()
+			release := <-api.finding
+
+			So(w.isOurs("ours"), ShouldBeTrue)
+			So(sent("existing", "someone", "hello"), ShouldBeTrue)
+
+			close(release)
+			So(<-done, ShouldBeTrue)
+			So(api.created, ShouldResemble, []string{"new"})
+		})
+
+		Convey("Each nick gets its own avatar, which is always the same", func() {
+			w.send("existing", "someone", "hello")
+			w.send("existing", "SomeOne", "hello")
+			w.send("existing", "other", "hello")
+			So(api.executed[0].AvatarURL, ShouldStartWith, "https://www.gravatar.com/avatar/")
+			So(api.executed[0].AvatarURL, ShouldEqual, api.executed[1].AvatarURL)
+			So(api.executed[0].AvatarURL, ShouldNotEqual, api.executed[2].AvatarURL)
+		})
+
+		Convey("Without permission to manage webhooks, the bot posts instead until it is worth trying again", func() {
+			api.forbidden = true
+			So(sent("existing", "someone", "hello"), ShouldBeFalse)
+
+			api.forbidden = false
+			So(sent("existing", "someone", "hello"), ShouldBeFalse)
+			clk.advance(dWebhookRetryInterval)
+			So(sent("existing", "someone", "hello"), ShouldBeTrue)
+		})
+
+		Convey("If posting through the webhook fails, the bot posts instead", func() {
+			api.executeErr = errors.New("Unknown Webhook")
+			So(sent("new", "someone", "hello"), ShouldBeFalse)
+
+			api.executeErr = nil
+			So(sent("new", "someone", "hello"), ShouldBeTrue)
+		})
+	})
+
+	Convey("When nicks are used as webhook usernames", t, func() {
+		tests := []struct {
+			nick, username string
+		}{
+			{"someone", "someone"},
+			{"discordian", "d\u200biscordian"},
+			{"CLYDE", "C\u200bLYDE"},
+			{strings.Repeat("x", 100), strings.Repeat("x", 80)},
+		}
+		for _, test := range tests {
+			So(webhookUsername(test.nick), ShouldEqual, test.username)
+		}
+	})
+
+	Convey("When a custom avatar URL is configured", t, func() {
+		conf = Config{Discord: DiscordConfig{WebhookAvatarURL: "https://avatars.example.com/%s.png"}}
+		defer func() { conf = Config{} }()
+
+		So(webhookAvatarURL("someone"), ShouldStartWith, "https://avatars.example.com/")
+		So(webhookAvatarURL("someone"), ShouldHaveLength, len("https://avatars.example.com/.png")+64)
+	})
+
+	Convey("When the custom avatar URL doesn't have exactly one %s", t, func() {
+		hook := logtest.NewGlobal()
+		defer log.StandardLogger().ReplaceHooks(log.LevelHooks{})
+		defer func() { conf = Config{} }()
+
+		for _, template := range []string{"https://avatars.example.com/x.png", "https://a.example.com/%s/%s.png",
+			"https://a.example.com/%d.png?n=%s", "https://a.example.com/%2F%s.png"} {
+			conf = Config{Discord: DiscordConfig{WebhookAvatarURL: template}}
+			checkWebhookAvatarURL()
+			So(hook.LastEntry().Level, ShouldEqual, log.WarnLevel)
+			So(hook.LastEntry().Message, ShouldContainSubstring, template)
+			So(webhookAvatarURL("someone"), ShouldStartWith, "https://www.gravatar.com/avatar/")
+		}
+
+		hook.Reset()
+		conf = Config{Discord: DiscordConfig{WebhookAvatarURL: "https://a.example.com/%s.png?s=100%%"}}
+		checkWebhookAvatarURL()
+		So(hook.LastEntry(), ShouldBeNil)
+		So(webhookAvatarURL("someone"), ShouldEndWith, ".png?s=100%")
+	})
+}
@@ -0,0 +1,148 @@
+package format
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	sgrReset         = 0
+	sgrBold          = 1
+	sgrItalic        = 3
+	sgrUnderline     = 4
+	sgrReverse       = 7
+	sgrConceal       = 8
+	sgrStrikethrough = 9
+
+	sgrForeground = 30
+	sgrBackground = 40
+
+	// sgrForegroundRGB and sgrBackgroundRGB are followed by `2;r;g;b` to select a 24-bit color
+	sgrForegroundRGB = 38
+	sgrBackgroundRGB = 48
+)
+
+// discordANSIForeground and discordANSIBackground hold the RGB values Discord displays for SGR colors 30-37 and 40-47
+// Discord only supports these eight of each, and they differ between foreground and background
+var discordANSIForeground = [8][3]uint8{
+	{0x4F, 0x54, 0x5C}, {0xDC, 0x32, 0x2F}, {0x85, 0x99, 0x00}, {0xB5, 0x89, 0x00},
+	{0x26, 0x8B, 0xD2}, {0xD3, 0x36, 0x82}, {0x2A, 0xA1, 0x98}, {0xFF, 0xFF, 0xFF},
+}
+var discordANSIBackground = [8][3]uint8{
+	{0x00, 0x2B, 0x36}, {0xCB, 0x4B, 0x16}, {0x58, 0x6E, 0x75}, {0x65, 0x7B, 0x83},
+	{0x83, 0x94, 0x96}, {0x6C, 0x71, 0xC4}, {0x93, 0xA1, 0xA1}, {0xFD, 0xF6, 0xE3},
+}
+
+// HasColor returns whether any part of `fs` has a color
+func (fs FormattedString) HasColor() bool {
+	for _, span := range fs {
+		if !span.IsZeroColor() {
+			return true
+		}
+	}
+	return false
+}
+
+// RenderANSI renders a FormattedString into text for an ANSI terminal, using SGR escape sequences and 24-bit color
+func (fs FormattedString) RenderANSI() string {
+	return renderSGR(fs, func(span Span) []int {
+		codes := []int{sgrReset}
+		for _, f := range []struct {
+			format format
+			code   int
+		}{
+			{Bold, sgrBold},
+			{Italic, sgrItalic},
+			{Underline, sgrUnderline},
+			{Reverse, sgrReverse},
+			{Spoiler, sgrConceal},
+			{Strikethrough, sgrStrikethrough},
+		} {
+			if (span.Format & f.format) != 0 {
+				codes = append(codes, f.code)
+			}
+		}
+
+		if r, g, b, ok := span.Foreground.RGB(); ok {
+			codes = append(codes, sgrForegroundRGB, 2, int(r), int(g), int(b))
+		}
+		if r, g, b, ok := span.Background.RGB(); ok {
+			codes = append(codes, sgrBackgroundRGB, 2, int(r), int(g), int(b))
+		}
+		return codes
+	})
+}
+
+// DiscordANSICodeBlock renders a FormattedString into an ```ansi code block, which Discord displays in color
+// Only bold and underline are supported, and colors are mapped to the nearest of the eight Discord supports
+func (fs FormattedString) DiscordANSICodeBlock() CodeBlock {
+	text := renderSGR(fs, func(span Span) []int {
+		span = span.withSpoilerColors()
+		if (span.Format & Reverse) != 0 {
+			span.Foreground, span.Background = span.Background, span.Foreground
+		}
+
+		codes := []int{sgrReset}
+		if (span.Format & Bold) != 0 {
+			codes = append(codes, sgrBold)
+		}
+		if (span.Format & Underline) != 0 {
+			codes = append(codes, sgrUnderline)
+		}
+		if c, ok := nearestANSIColor(span.Foreground, discordANSIForeground); ok {
+			codes = append(codes, sgrForeground+c)
+		}
+		if c, ok := nearestANSIColor(span.Background, discordANSIBackground); ok {
+			codes = append(codes, sgrBackground+c)
+		}
+		return codes
+	})
+
+	return CodeBlock{Language: "ansi", Text: text}
+}
+
+// renderSGR renders a FormattedString with an SGR escape sequence before each span, using the parameters from `codes`
+// Sequences are only emitted when the parameters change, and the formatting is reset at the end
+func renderSGR(fs FormattedString, codes func(Span) []int) string {
+	output := ""
+
+	lastSGR := ""
+	for _, span := range fs.Normalize() {
+		params := []string{}
+		for _, code := range codes(span) {
+			params = append(params, strconv.Itoa(code))
+		}
+
+		if sgr := strings.Join(params, ";"); sgr != lastSGR {
+			output += "\x1b[" + sgr + "m"
+			lastSGR = sgr
+		}
+		output += span.Text
+	}
+
+	if lastSGR != "" {
+		output += "\x1b[0m"
+	}
+
+	return output
+}
+
+// nearestANSIColor returns the index of the color in `palette` nearest to `c`
+// The default color has no RGB value, so `ok` is false for it
+func nearestANSIColor(c color, palette [8][3]uint8) (index int, ok bool) {
+	r, g, b, ok := c.RGB()
+	if !ok {
+		return 0, false
+	}
+	target := [3]uint8{r, g, b}
+
+	minDistance := uint32(0xFFFFFFFF)
+	for i, col := range palette {
+		if distance := colorDistance(target, col); distance < minDistance {
+			minDistance = distance
+			index = i
+		}
+	}
+
+	return index, true
+}
@@ -0,0 +1,72 @@
+package format
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRenderANSI(t *testing.T) {
+	Convey("When RenderANSI is used", t, func() {
+		cases := []testCase{
+			{"", []Span{}},
+			{"\x1b[0mfoo\x1b[0m", []Span{
+				{"foo", None, Default, Default},
+			}},
+			{"\x1b[0;1;3;4mfoo\x1b[0;7;8;9mbar\x1b[0mbaz\x1b[0m", []Span{
+				{"foo", Bold | Italic | Underline, Default, Default},
+				{"bar", Strikethrough | Spoiler | Monospace | Reverse, Default, Default},
+				{"baz", Monospace, Default, Default},
+			}},
+			{"\x1b[0;38;2;0;0;127;48;2;0;0;0mfoo\x1b[0;38;2;18;52;86mbar\x1b[0m", []Span{
+				{"foo", None, Blue, Black},
+				{"bar", None, rgbColor(0x12, 0x34, 0x56), Default},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.structured), func() {
+				So(c.structured.RenderANSI(), ShouldEqual, c.raw)
+			})
+		}
+	})
+}
+
+func TestDiscordANSICodeBlock(t *testing.T) {
+	Convey("When DiscordANSICodeBlock is used", t, func() {
+		cases := []testCase{
+			{"", []Span{}},
+			{"\x1b[0mfoo\x1b[0m", []Span{
+				{"foo", None, Default, Default},
+			}},
+			{"\x1b[0;31mfoo\x1b[0;32;40mbar\x1b[0mbaz\x1b[0m", []Span{
+				{"foo", None, BrightRed, Default},
+				{"bar", None, Green, Black},
+				{"baz", None, Default, Default},
+			}},
+			{"\x1b[0;1;4;34mfoo\x1b[0;1;34mbar\x1b[0m", []Span{
+				{"foo", Bold | Underline, BrightBlue, Default},
+				{"bar", Bold | Italic, BrightBlue, Default},
+			}},
+			{"\x1b[0;33mfoo\x1b[0;37;41mbar\x1b[0m", []Span{
+				{"foo", None, rgbColor(0xC0, 0x90, 0x10), Default},
+				{"bar", Reverse, rgbColor(0xC0, 0x50, 0x10), White},
+			}},
+			{"\x1b[0;30;40mfoo\x1b[0m", []Span{
+				{"foo", Spoiler, Default, Default},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.structured), func() {
+				So(c.structured.DiscordANSICodeBlock(), ShouldResemble, CodeBlock{"ansi", c.raw})
+			})
+		}
+	})
+
+	Convey("When HasColor is used", t, func() {
+		So(FormattedString{{"foo", Bold, Default, Default}}.HasColor(), ShouldBeFalse)
+		So(FormattedString{{"foo", None, Default, Default}, {"bar", None, Default, Red}}.HasColor(), ShouldBeTrue)
+	})
+}
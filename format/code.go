@@ -0,0 +1,124 @@
+package format
+
+import (
+	"strings"
+)
+
+// CodeBlock represents a multi-line block of preformatted text, such as a Discord ``` code block
+type CodeBlock struct {
+	Language string
+	Text     string
+}
+
+// Block represents a section of a multi-line message: either ordinary text, or a code block
+type Block struct {
+	Text string
+	Code *CodeBlock
+}
+
+const codeFence = "```"
+
+// SplitDiscordCodeBlocks splits an incoming Discord message into sections of ordinary text and code blocks
+// The text sections are left unparsed, since they are usually handled line by line
+func SplitDiscordCodeBlocks(s string) []Block {
+	blocks := []Block{}
+
+	text := ""
+	for s != "" {
+		fence := strings.Index(s, codeFence)
+		if fence == -1 {
+			text += s
+			break
+		}
+
+		code, length, ok := matchDiscordCodeBlock(s[fence:])
+		if !ok {
+			text += s[:fence+len(codeFence)]
+			s = s[fence+len(codeFence):]
+			continue
+		}
+
+		text += strings.TrimSuffix(s[:fence], "\n")
+		if text != "" {
+			blocks = append(blocks, Block{Text: text})
+		}
+		blocks = append(blocks, Block{Code: &code})
+
+		text = ""
+		s = strings.TrimPrefix(s[fence+length:], "\n")
+	}
+
+	if text != "" {
+		blocks = append(blocks, Block{Text: text})
+	}
+
+	return blocks
+}
+
+// matchDiscordCodeBlock matches a ``` code block at the start of `s`
+func matchDiscordCodeBlock(s string) (code CodeBlock, length int, ok bool) {
+	if !strings.HasPrefix(s, codeFence) {
+		return
+	}
+	start := len(codeFence)
+
+	// The language is only present if it is alone on the first line, and the block must have something else in it
+	if newline := strings.IndexByte(s[start:], '\n'); newline > 0 && isCodeLanguage(s[start:start+newline]) {
+		if code, length, ok = matchDiscordCodeContent(s, start+newline+1); ok {
+			code.Language = s[start : start+newline]
+			return
+		}
+	}
+
+	return matchDiscordCodeContent(s, start)
+}
+
+// matchDiscordCodeContent matches the content and closing fence of a code block starting at `s[start:]`
+func matchDiscordCodeContent(s string, start int) (code CodeBlock, length int, ok bool) {
+	for start < len(s) && s[start] == '\n' {
+		start++
+	}
+	if start >= len(s) {
+		return
+	}
+
+	end := strings.Index(s[start+1:], codeFence)
+	if end == -1 {
+		return
+	}
+	end += start + 1
+
+	code.Text = strings.TrimRight(s[start:end], "\n")
+	return code, end + len(codeFence), true
+}
+
+func isCodeLanguage(s string) bool {
+	for _, c := range []byte(s) {
+		if !isAlphanumeric(c) && !strings.ContainsRune("_+-.#", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Lines returns the lines of the code block
+func (c CodeBlock) Lines() []string {
+	return strings.Split(c.Text, "\n")
+}
+
+// FormattedLines returns the lines of the code block in monospace
+func (c CodeBlock) FormattedLines() []FormattedString {
+	lines := []FormattedString{}
+	for _, line := range c.Lines() {
+		lines = append(lines, FormattedString{{Text: line, Format: Monospace}})
+	}
+	return lines
+}
+
+// RenderDiscord renders a code block into a Discord message
+func (c CodeBlock) RenderDiscord() string {
+	// Discord has no way to escape a fence inside a code block; break it up with a U+FEFF instead
+	text := strings.Replace(c.Text, codeFence, "``\uFEFF`", -1)
+
+	return codeFence + c.Language + "\n" + text + "\n" + codeFence
+}
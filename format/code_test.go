@@ -0,0 +1,91 @@
+package format
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSplitDiscordCodeBlocks(t *testing.T) {
+	Convey("When SplitDiscordCodeBlocks is used", t, func() {
+		cases := []struct {
+			raw    string
+			blocks []Block
+		}{
+			{"", []Block{}},
+			{"foo\nbar", []Block{
+				{Text: "foo\nbar"},
+			}},
+			{"```foo```", []Block{
+				{Code: &CodeBlock{"", "foo"}},
+			}},
+			{"```go\nfoo()\n\nbar()\n```", []Block{
+				{Code: &CodeBlock{"go", "foo()\n\nbar()"}},
+			}},
+			{"```\n\nfoo bar\n\n```", []Block{
+				{Code: &CodeBlock{"", "foo bar"}},
+			}},
+			{"```foo bar\nbaz```", []Block{
+				{Code: &CodeBlock{"", "foo bar\nbaz"}},
+			}},
+			{"foo\n```c++\n**bar**\n```\nbaz", []Block{
+				{Text: "foo"},
+				{Code: &CodeBlock{"c++", "**bar**"}},
+				{Text: "baz"},
+			}},
+			{"foo ```bar``` baz ```quux```", []Block{
+				{Text: "foo "},
+				{Code: &CodeBlock{"", "bar"}},
+				{Text: " baz "},
+				{Code: &CodeBlock{"", "quux"}},
+			}},
+			{"foo ```bar", []Block{
+				{Text: "foo ```bar"},
+			}},
+			{"``````", []Block{
+				{Text: "``````"},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %q is passed", c.raw), func() {
+				So(SplitDiscordCodeBlocks(c.raw), ShouldResemble, c.blocks)
+			})
+		}
+	})
+}
+
+func TestRenderDiscordCodeBlock(t *testing.T) {
+	Convey("When CodeBlock.RenderDiscord is used", t, func() {
+		cases := []struct {
+			raw  string
+			code CodeBlock
+		}{
+			{"```\nfoo\n```", CodeBlock{"", "foo"}},
+			{"```go\nfoo()\n\nbar()\n```", CodeBlock{"go", "foo()\n\nbar()"}},
+			{"```md\n**foo** __bar__\n```", CodeBlock{"md", "**foo** __bar__"}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.code), func() {
+				So(c.code.RenderDiscord(), ShouldEqual, c.raw)
+
+				// check the round-trip works too
+				So(SplitDiscordCodeBlocks(c.code.RenderDiscord()), ShouldResemble, []Block{{Code: &c.code}})
+			})
+		}
+
+		Convey("When the code contains a fence", func() {
+			So(CodeBlock{"", "foo ``` bar"}.RenderDiscord(), ShouldEqual, "```\nfoo ``\uFEFF` bar\n```")
+		})
+	})
+
+	Convey("When CodeBlock.FormattedLines is used", t, func() {
+		So(CodeBlock{"go", "foo()\n\n  bar()"}.FormattedLines(), ShouldResemble, []FormattedString{
+			{{"foo()", Monospace, Default, Default}},
+			{{"", Monospace, Default, Default}},
+			{{"  bar()", Monospace, Default, Default}},
+		})
+	})
+}
@@ -3,71 +3,341 @@ package format
 import (
 	"regexp"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // ParseDiscord parses an incoming Discord message to a FormattedString
+//
+// The rules follow those of the markdown library Discord uses, so that text is formatted the same way Discord shows it:
+// `*italic*` or `_italic_`, `**bold**`, `__underline__`, `~~strikethrough~~` and `||spoilers||` may be nested,
+// `\` escapes any punctuation character, and neither `inline code` nor URLs are parsed for formatting.
 func ParseDiscord(s string) FormattedString {
-	return FormattedString{
-		{Text: s},
+	return FormattedString(parseDiscordInto([]Span{}, s, None))
+}
+
+// parseDiscordInto parses `s` with `f` as the base format, appending the result to `spans`
+func parseDiscordInto(spans []Span, s string, f format) []Span {
+	for i := 0; i < len(s); {
+		if code, length := matchDiscordInlineCode(s[i:]); length != 0 {
+			spans = appendText(spans, code, f|Monospace)
+			i = skipFormatSeparator(s, i+length)
+			continue
+		}
+
+		if inner, innerFormat, length, ok := matchDiscordFormat(s[i:]); ok {
+			spans = parseDiscordInto(spans, inner, f|innerFormat)
+			i = skipFormatSeparator(s, i+length)
+			continue
+		}
+
+		text, length := matchDiscordLiteral(s[i:], i == 0 || isSpaceBefore(s[:i]))
+		spans = appendText(spans, text, f)
+		i += length
 	}
+
+	return spans
 }
 
-var discordEscape = regexp.MustCompile(`[\\*_]`)
-var discordEscapeNoUnderscore = regexp.MustCompile(`[\\*]`)
-var backticks = regexp.MustCompile("`+")
+// skipFormatSeparator skips the U+FEFF that RenderDiscord adds after format codes to avoid them running together, if present at `s[i:]`
+func skipFormatSeparator(s string, i int) int {
+	if strings.HasPrefix(s[i:], "\uFEFF") {
+		return i + len("\uFEFF")
+	}
+	return i
+}
 
-var trimmer = regexp.MustCompile(`^(\s*)(.*?\S)?(\s*)$`)
+// appendText appends `text` with format `f` to `spans`, merging it into the last span if the formats match
+func appendText(spans []Span, text string, f format) []Span {
+	if len(spans) != 0 && spans[len(spans)-1].Format == f && spans[len(spans)-1].IsZeroColor() {
+		spans[len(spans)-1].Text += text
+		return spans
+	}
+	return append(spans, Span{Text: text, Format: f})
+}
 
-// RenderDiscord renders a FormattedString into a Discord message
-func (fs FormattedString) RenderDiscord() string { // nolint: gocyclo
-	output := ""
-	escape := func(s []byte) []byte { return append([]byte("\\"), s...) }
-	for _, span := range fs {
-
-		finishedData := []byte{}
-		data := []byte(span.Text)
-
-		begin := 0
-		var end int
-		bt := false
-		for begin < len(data) {
-			firstBackticks := backticks.FindIndex(data[begin:])
-			if firstBackticks != nil {
-				end = begin + firstBackticks[1]
-			} else {
-				end = len(data)
-			}
+// matchDiscordFormat finds the best-matching format rule at the start of `s`
+// Like Discord, the longest match wins, and italics win a tie
+func matchDiscordFormat(s string) (inner string, f format, length int, ok bool) {
+	if inner, length, ok = matchDiscordItalic(s); ok {
+		f = Italic
+	}
+	if strongInner, strongLength, strongOK := matchDiscordDelimited(s, "**"); strongOK && strongLength > length {
+		inner, f, length, ok = strongInner, Bold, strongLength, true
+	}
+	if uInner, uLength, uOK := matchDiscordDelimited(s, "__"); uOK && uLength > length {
+		inner, f, length, ok = uInner, Underline, uLength, true
+	}
+	if delInner, delLength, delOK := matchDiscordStrikethrough(s); delOK && delLength > length {
+		inner, f, length, ok = delInner, Strikethrough, delLength, true
+	}
+	if spoilerInner, spoilerLength, spoilerOK := matchDiscordSpoiler(s); spoilerOK && spoilerLength > length {
+		inner, f, length, ok = spoilerInner, Spoiler, spoilerLength, true
+	}
+	return
+}
 
-			if bt {
-				finishedData = append(finishedData, data[begin:end]...)
-			} else {
-				words := strings.SplitAfter(string(data[begin:end]), " ")
-				for _, word := range words {
-					if strings.HasPrefix(word, "http://") || strings.HasPrefix(word, "https://") {
-						finishedData = append(finishedData, []byte(word)...)
-					} else if len(word) > 0 {
-						first := word[0]
-						var last byte
-						for n := 1; n < len(word); n++ {
-							if word[len(word)-n] != ' ' {
-								last = word[len(word)-n]
-								break
-							}
-						}
-
-						if first == ':' && last == ':' {
-							finishedData = append(finishedData, discordEscapeNoUnderscore.ReplaceAllFunc([]byte(word), escape)...)
-						} else {
-							finishedData = append(finishedData, discordEscape.ReplaceAllFunc([]byte(word), escape)...)
-						}
-					}
-				}
+// matchDiscordLiteral matches a piece of unformatted text at the start of `s`: an escaped character, a URL or a single character
+func matchDiscordLiteral(s string, wordStart bool) (text string, length int) {
+	if s[0] == '\\' && len(s) > 1 {
+		r, n := utf8.DecodeRuneInString(s[1:])
+		if !unicode.IsSpace(r) && !isAlphanumeric(s[1]) {
+			return string(r), 1 + n
+		}
+	}
+
+	if wordStart {
+		if length = matchDiscordURL(s); length != 0 {
+			return s[:length], length
+		}
+	}
+
+	_, length = utf8.DecodeRuneInString(s)
+	return s[:length], length
+}
+
+// matchDiscordItalic matches `*italic*` or `_italic_` at the start of `s`
+func matchDiscordItalic(s string) (inner string, length int, ok bool) {
+	if len(s) < 3 {
+		return
+	}
+
+	var unit func(string) int
+	var closes func(string) bool
+	switch s[0] {
+	case '*':
+		if r, _ := utf8.DecodeRuneInString(s[1:]); unicode.IsSpace(r) {
+			return
+		}
+		unit = discordItalicStarUnit
+		closes = func(rest string) bool { return rest[0] == '*' && (len(rest) == 1 || rest[1] != '*') }
+	case '_':
+		unit = discordItalicUnderscoreUnit
+		closes = func(rest string) bool { return rest[0] == '_' && (len(rest) == 1 || !isWordChar(rest[1])) }
+	default:
+		return
+	}
+
+	for i := 1; i < len(s); {
+		n := unit(s[i:])
+		if n == 0 {
+			return
+		}
+		i += n
+
+		if i < len(s) && closes(s[i:]) {
+			return s[1:i], i + 1, true
+		}
+	}
+	return
+}
+
+// discordItalicStarUnit returns the length of the next piece of a *italic* section, or 0 if there is none
+func discordItalicStarUnit(s string) int {
+	switch {
+	case strings.HasPrefix(s, "**"):
+		return 2
+	case s[0] == '*':
+		return 0
+	case s[0] == '\\':
+		return escapeLength(s)
+	}
+
+	r, n := utf8.DecodeRuneInString(s)
+	if !unicode.IsSpace(r) {
+		return n
+	}
+
+	// Whitespace is only allowed when followed by something else that is allowed
+	spaces := len(s) - len(strings.TrimLeftFunc(s, unicode.IsSpace))
+	if spaces == len(s) {
+		return 0
+	}
+	if next := discordItalicStarUnit(s[spaces:]); next != 0 {
+		return spaces + next
+	}
+	return 0
+}
+
+// discordItalicUnderscoreUnit returns the length of the next piece of a _italic_ section, or 0 if there is none
+func discordItalicUnderscoreUnit(s string) int {
+	switch {
+	case strings.HasPrefix(s, "__"):
+		return 2
+	case s[0] == '_':
+		return 0
+	case s[0] == '\\':
+		return escapeLength(s)
+	}
+
+	_, n := utf8.DecodeRuneInString(s)
+	return n
+}
+
+// matchDiscordDelimited matches a section surrounded by `delim` at the start of `s`, such as **bold** or __underline__
+func matchDiscordDelimited(s, delim string) (inner string, length int, ok bool) {
+	if !strings.HasPrefix(s, delim) {
+		return
+	}
+
+	for i := len(delim); i < len(s); {
+		if s[i] == '\\' {
+			n := escapeLength(s[i:])
+			if n == 0 {
+				return
 			}
-			bt = !bt
-			begin = end
+			i += n
+		} else {
+			_, n := utf8.DecodeRuneInString(s[i:])
+			i += n
+		}
+
+		if strings.HasPrefix(s[i:], delim) && !strings.HasPrefix(s[i+len(delim):], delim[:1]) {
+			return s[len(delim):i], i + len(delim), true
+		}
+	}
+	return
+}
+
+// matchDiscordStrikethrough matches `~~strikethrough~~` at the start of `s`
+func matchDiscordStrikethrough(s string) (inner string, length int, ok bool) {
+	if !strings.HasPrefix(s, "~~") || len(s) < 5 {
+		return
+	}
+	if r, _ := utf8.DecodeRuneInString(s[2:]); unicode.IsSpace(r) {
+		return
+	}
+
+	for i := 2; i < len(s); {
+		r, n := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '\\':
+			n = escapeLength(s[i:])
+		case r == '~' && strings.HasPrefix(s[i+1:], "~"):
+			n = 0
+		case unicode.IsSpace(r) && strings.HasPrefix(s[i+n:], "~~"):
+			n = 0
+		}
+		if n == 0 {
+			return
+		}
+		i += n
+
+		if strings.HasPrefix(s[i:], "~~") {
+			return s[2:i], i + 2, true
+		}
+	}
+	return
+}
+
+// matchDiscordSpoiler matches `||spoiler||` at the start of `s`
+func matchDiscordSpoiler(s string) (inner string, length int, ok bool) {
+	if !strings.HasPrefix(s, "||") || len(s) < 5 {
+		return
+	}
+
+	end := strings.Index(s[3:], "||")
+	if end == -1 {
+		return
+	}
+	end += 3
+	return s[2:end], end + 2, true
+}
+
+// matchDiscordInlineCode matches the `inline code` section at the start of `s`, returning its content and length
+func matchDiscordInlineCode(s string) (code string, length int) {
+	ticks := len(s) - len(strings.TrimLeft(s, "`"))
+	if ticks == 0 {
+		return
+	}
+	fence := s[:ticks]
+
+	for i := ticks + 1; i+ticks <= len(s); i++ {
+		if s[i-1] != '`' && strings.HasPrefix(s[i:], fence) && (i+ticks == len(s) || s[i+ticks] != '`') {
+			return trimInlineCodePadding(s[ticks:i]), i + ticks
 		}
+	}
+	return
+}
+
+// trimInlineCodePadding removes the space Discord allows to separate the fence from code starting or ending with a backtick
+func trimInlineCodePadding(code string) string {
+	if strings.HasPrefix(strings.TrimLeft(code, " "), "`") && strings.HasPrefix(code, " ") {
+		code = code[1:]
+	}
+	if strings.HasSuffix(strings.TrimRight(code, " "), "`") && strings.HasSuffix(code, " ") {
+		code = code[:len(code)-1]
+	}
+	return code
+}
+
+// matchDiscordURL returns the length of the URL at the start of `s`, or 0 if there is none
+func matchDiscordURL(s string) int {
+	prefix := ""
+	if strings.HasPrefix(s, "http://") {
+		prefix = "http://"
+	} else if strings.HasPrefix(s, "https://") {
+		prefix = "https://"
+	} else {
+		return 0
+	}
+
+	end := strings.IndexFunc(s, func(r rune) bool { return r == '<' || unicode.IsSpace(r) })
+	if end == -1 {
+		end = len(s)
+	}
+
+	// Trailing punctuation is not considered part of the URL
+	end = len(strings.TrimRight(s[:end], `.,:;"')]`))
+	if end < len(prefix)+2 {
+		return 0
+	}
+	return end
+}
+
+// escapeLength returns the length of the backslash-escaped character at the start of `s`, or 0 if there is none
+func escapeLength(s string) int {
+	if len(s) < 2 {
+		return 0
+	}
+	_, n := utf8.DecodeRuneInString(s[1:])
+	return 1 + n
+}
+
+func isSpaceBefore(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return unicode.IsSpace(r)
+}
 
-		t := string(finishedData)
+func isAlphanumeric(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isWordChar(c byte) bool {
+	return isAlphanumeric(c) || c == '_'
+}
+
+var discordEscape = regexp.MustCompile("[\\\\*_~|`]")
+var discordEscapeNoUnderscore = regexp.MustCompile("[\\\\*~|`]")
+var backticks = regexp.MustCompile("`+")
+
+// discordFormats are the formats which Discord can display; the rest, such as Reverse, are dropped by RenderDiscord
+const discordFormats = Bold | Italic | Underline | Strikethrough | Spoiler | Monospace
+
+// trimmer splits text into its leading whitespace, its content and its trailing whitespace, across any number of lines
+var trimmer = regexp.MustCompile(`(?s)^(\s*)(.*?\S)?(\s*)$`)
+
+// RenderDiscord renders a FormattedString into a Discord message
+func (fs FormattedString) RenderDiscord() string {
+	output := ""
+	for _, span := range fs.Normalize() {
+		t := span.Text
+		if (span.Format & Monospace) == 0 {
+			t = escapeDiscord(t, (span.Format&discordFormats) == None)
+		} else if strings.ContainsAny(t, "*_~|") {
+			// Discord ends any other format at the first marker it finds, even inside code, and code can't be escaped
+			span.Format &^= discordFormats &^ Monospace
+		}
 
 		matches := trimmer.FindAllStringSubmatch(t, -1)
 
@@ -76,6 +346,9 @@ func (fs FormattedString) RenderDiscord() string { // nolint: gocyclo
 		final := matches[0][3]
 
 		if text != "" {
+			if (span.Format & Monospace) != 0 {
+				text = wrapInlineCode(text)
+			}
 			if (span.Format & Italic) != 0 {
 				text = "*" + text + "*"
 			}
@@ -85,9 +358,15 @@ func (fs FormattedString) RenderDiscord() string { // nolint: gocyclo
 			if (span.Format & Underline) != 0 {
 				text = "__" + text + "__"
 			}
+			if (span.Format & Strikethrough) != 0 {
+				text = "~~" + text + "~~"
+			}
+			if (span.Format & Spoiler) != 0 {
+				text = "||" + text + "||"
+			}
 
 			// add a U+FEFF to avoid running together format codes; "*foo*\ufeff**bar**" instead of "*foo***bar**"
-			if final == "" && span.Format != None {
+			if final == "" && (span.Format&discordFormats) != None {
 				text = text + "\uFEFF"
 			}
 		}
@@ -97,3 +376,80 @@ func (fs FormattedString) RenderDiscord() string { // nolint: gocyclo
 
 	return output
 }
+
+// escapeDiscord escapes any characters in `s` that Discord would otherwise interpret as formatting
+// URLs and emoji are left alone, and so is inline code if `keepCode` is set, since IRC users write it the same way
+func escapeDiscord(s string, keepCode bool) string {
+	output := ""
+	for s != "" {
+		start, end := len(s), len(s)
+		if keepCode {
+			start, end = findInlineCode(s)
+		}
+
+		output += escapeDiscordText(s[:start]) + s[start:end]
+		s = s[end:]
+	}
+	return output
+}
+
+// escapeDiscordText escapes `s` word by word, leaving URLs and emoji readable
+func escapeDiscordText(s string) string {
+	escape := func(s []byte) []byte { return append([]byte("\\"), s...) }
+
+	finishedData := []byte{}
+	for _, word := range strings.SplitAfter(s, " ") {
+		if strings.HasPrefix(word, "http://") || strings.HasPrefix(word, "https://") {
+			finishedData = append(finishedData, []byte(word)...)
+		} else if len(word) > 0 {
+			first := word[0]
+			var last byte
+			for n := 1; n < len(word); n++ {
+				if word[len(word)-n] != ' ' {
+					last = word[len(word)-n]
+					break
+				}
+			}
+
+			if first == ':' && last == ':' {
+				finishedData = append(finishedData, discordEscapeNoUnderscore.ReplaceAllFunc([]byte(word), escape)...)
+			} else {
+				finishedData = append(finishedData, discordEscape.ReplaceAllFunc([]byte(word), escape)...)
+			}
+		}
+	}
+
+	return string(finishedData)
+}
+
+// findInlineCode returns the position of the first inline code in `s`, including its backticks, or len(s) if there is
+// none; the code must be closed by a run of as many backticks as it was opened with
+func findInlineCode(s string) (start, end int) {
+	runs := backticks.FindAllStringIndex(s, -1)
+	for i, open := range runs {
+		for _, close := range runs[i+1:] {
+			if close[1]-close[0] == open[1]-open[0] {
+				return open[0], close[1]
+			}
+		}
+	}
+	return len(s), len(s)
+}
+
+// wrapInlineCode wraps `s` in a backtick fence longer than any run of backticks inside it
+func wrapInlineCode(s string) string {
+	fence := "`"
+	for _, run := range backticks.FindAllString(s, -1) {
+		if len(run) >= len(fence) {
+			fence = run + "`"
+		}
+	}
+
+	if strings.HasPrefix(s, "`") {
+		s = " " + s
+	}
+	if strings.HasSuffix(s, "`") {
+		s = s + " "
+	}
+	return fence + s + fence
+}
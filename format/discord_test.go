@@ -0,0 +1,185 @@
+package format
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseDiscord(t *testing.T) {
+	Convey("When ParseDiscord is used", t, func() {
+		cases := []testCase{
+			{"", []Span{}},
+			{"foo", []Span{
+				{"foo", None, Default, Default},
+			}},
+			{"*foo*", []Span{
+				{"foo", Italic, Default, Default},
+			}},
+			{"_foo_", []Span{
+				{"foo", Italic, Default, Default},
+			}},
+			{"**foo**", []Span{
+				{"foo", Bold, Default, Default},
+			}},
+			{"__foo__", []Span{
+				{"foo", Underline, Default, Default},
+			}},
+			{"***foo***", []Span{
+				{"foo", Bold | Italic, Default, Default},
+			}},
+			{"__***foo***__", []Span{
+				{"foo", Bold | Italic | Underline, Default, Default},
+			}},
+			{"foo **bar** baz", []Span{
+				{"foo ", None, Default, Default},
+				{"bar", Bold, Default, Default},
+				{" baz", None, Default, Default},
+			}},
+			{"**foo *bar* baz**", []Span{
+				{"foo ", Bold, Default, Default},
+				{"bar", Bold | Italic, Default, Default},
+				{" baz", Bold, Default, Default},
+			}},
+			{"*foo*\uFEFF**bar**\uFEFF", []Span{
+				{"foo", Italic, Default, Default},
+				{"bar", Bold, Default, Default},
+			}},
+			{"\\*foo\\*", []Span{
+				{"*foo*", None, Default, Default},
+			}},
+			{"\\\\foo\\b", []Span{
+				{"\\foo\\b", None, Default, Default},
+			}},
+			{"snake_case_name", []Span{
+				{"snake_case_name", None, Default, Default},
+			}},
+			{"* foo*", []Span{
+				{"* foo*", None, Default, Default},
+			}},
+			{"**foo", []Span{
+				{"**foo", None, Default, Default},
+			}},
+			{"`*foo*` *bar*", []Span{
+				{"*foo*", Monospace, Default, Default},
+				{" ", None, Default, Default},
+				{"bar", Italic, Default, Default},
+			}},
+			{"``foo`bar`` `` `baz` ``", []Span{
+				{"foo`bar", Monospace, Default, Default},
+				{" ", None, Default, Default},
+				{"`baz`", Monospace, Default, Default},
+			}},
+			{"**`foo`**", []Span{
+				{"foo", Bold | Monospace, Default, Default},
+			}},
+			{"~~foo~~ ||bar|| ~~ baz~~", []Span{
+				{"foo", Strikethrough, Default, Default},
+				{" ", None, Default, Default},
+				{"bar", Spoiler, Default, Default},
+				{" ~~ baz~~", None, Default, Default},
+			}},
+			{"||**foo** ~~bar~~||", []Span{
+				{"foo", Bold | Spoiler, Default, Default},
+				{" ", Spoiler, Default, Default},
+				{"bar", Strikethrough | Spoiler, Default, Default},
+			}},
+			{"see https://example.com/__foo__/*bar*.", []Span{
+				{"see https://example.com/__foo__/*bar*.", None, Default, Default},
+			}},
+			{"**ΨΩΔ**", []Span{
+				{"ΨΩΔ", Bold, Default, Default},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %q is passed", c.raw), func() {
+				So(ParseDiscord(c.raw), ShouldResemble, c.structured)
+			})
+		}
+	})
+}
+
+func TestRenderDiscord(t *testing.T) {
+	Convey("When RenderDiscord is used", t, func() {
+		cases := []testCase{
+			{"", []Span{}},
+			{"foo", []Span{
+				{"foo", None, Default, Default},
+			}},
+			{"*foo*\uFEFF", []Span{
+				{"foo", Italic, Default, Default},
+			}},
+			{"**foo**\uFEFF", []Span{
+				{"foo", Bold, Default, Default},
+			}},
+			{"__***foo***__\uFEFF", []Span{
+				{"foo", Bold | Italic | Underline, Default, Default},
+			}},
+			{"**foo**\uFEFF bar", []Span{
+				{"foo", Bold, Default, Default},
+				{" bar", None, Default, Default},
+			}},
+			{"*foo*\uFEFF**bar**\uFEFFbaz", []Span{
+				{"foo", Italic, Default, Default},
+				{"bar", Bold, Default, Default},
+				{"baz", None, Default, Default},
+			}},
+			{"\\*foo\\_bar\\\\", []Span{
+				{"*foo_bar\\", None, Default, Default},
+			}},
+			{"`*foo*`\uFEFF :foo_bar:", []Span{
+				{"*foo*", Monospace, Default, Default},
+				{" :foo_bar:", None, Default, Default},
+			}},
+			{"``` ``foo`` ```\uFEFF", []Span{
+				{"``foo``", Monospace, Default, Default},
+			}},
+			{"~~foo~~\uFEFF||bar||\uFEFF", []Span{
+				{"foo", Strikethrough, Default, Default},
+				{"bar", Spoiler, Default, Default},
+			}},
+			{"||~~**foo**~~||\uFEFF", []Span{
+				{"foo", Bold | Strikethrough | Spoiler, Default, Default},
+			}},
+			{"\\~\\~foo\\|\\|", []Span{
+				{"~~foo||", None, Default, Default},
+			}},
+			{"https://example.com/__foo__", []Span{
+				{"https://example.com/__foo__", None, Default, Default},
+			}},
+			{"**foo\nbar**\uFEFF", []Span{
+				{"foo\nbar", Bold, Default, Default},
+			}},
+			{"*\\`foo*\uFEFF", []Span{
+				{"`foo", Italic, Default, Default},
+			}},
+			{"ΨΩΔ", []Span{
+				{"ΨΩΔ", None, Default, Default},
+			}},
+		}
+
+		Convey("When code contains format markers", func() {
+			So(FormattedString{
+				{"foo*", Italic | Monospace, Default, Default},
+			}.RenderDiscord(), ShouldEqual, "`foo*`\uFEFF")
+		})
+
+		Convey("When formats and colors Discord can't display are used", func() {
+			So(FormattedString{
+				{"foo", Reverse, Red, Default},
+				{"bar", Bold | Reverse, color(50), color(90)},
+			}.RenderDiscord(), ShouldEqual, "foo**bar**\uFEFF")
+		})
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.structured), func() {
+				So(c.structured.RenderDiscord(), ShouldEqual, c.raw)
+
+				// check the round-trip works too
+				So(ParseDiscord(c.structured.RenderDiscord()), ShouldResemble, c.structured)
+			})
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package format
 
-import ()
+import (
+	"strings"
+)
 
 // Bitfield
 type format int
@@ -13,9 +15,13 @@ const (
 	Bold format = 1 << iota
 	Italic
 	Underline
+	Strikethrough
+	Spoiler
+	Monospace
+	Reverse
 )
 
-// Enum
+// Enum, or an arbitrary RGB value; see rgbColor
 type color int
 
 // Color codes
@@ -44,6 +50,125 @@ const (
 	LightGray = LightGrey
 )
 
+// numColors is the number of colors in the IRC palette, excluding the default
+// IRC colors 0-15 are the named colors above, and 16-98 are the extended colors added by modern clients
+const numColors = 99
+
+// colorRGB holds the RGB value of every color in the IRC palette, indexed by IRC color number
+var colorRGB = [numColors][3]uint8{
+	{0xFF, 0xFF, 0xFF}, {0x00, 0x00, 0x00}, {0x00, 0x00, 0x7F}, {0x00, 0x93, 0x00}, // 0-3
+	{0xFF, 0x00, 0x00}, {0x7F, 0x00, 0x00}, {0x9C, 0x00, 0x9C}, {0xFC, 0x7F, 0x00}, // 4-7
+	{0xFF, 0xFF, 0x00}, {0x00, 0xFC, 0x00}, {0x00, 0x93, 0x93}, {0x00, 0xFF, 0xFF}, // 8-11
+	{0x00, 0x00, 0xFC}, {0xFF, 0x00, 0xFF}, {0x7F, 0x7F, 0x7F}, {0xD2, 0xD2, 0xD2}, // 12-15
+
+	{0x47, 0x00, 0x00}, {0x47, 0x21, 0x00}, {0x47, 0x47, 0x00}, {0x32, 0x47, 0x00}, // 16-19
+	{0x00, 0x47, 0x00}, {0x00, 0x47, 0x2C}, {0x00, 0x47, 0x47}, {0x00, 0x27, 0x47}, // 20-23
+	{0x00, 0x00, 0x47}, {0x2E, 0x00, 0x47}, {0x47, 0x00, 0x47}, {0x47, 0x00, 0x2A}, // 24-27
+	{0x74, 0x00, 0x00}, {0x74, 0x3A, 0x00}, {0x74, 0x74, 0x00}, {0x51, 0x74, 0x00}, // 28-31
+	{0x00, 0x74, 0x00}, {0x00, 0x74, 0x49}, {0x00, 0x74, 0x74}, {0x00, 0x40, 0x74}, // 32-35
+	{0x00, 0x00, 0x74}, {0x4B, 0x00, 0x74}, {0x74, 0x00, 0x74}, {0x74, 0x00, 0x45}, // 36-39
+	{0xB5, 0x00, 0x00}, {0xB5, 0x63, 0x00}, {0xB5, 0xB5, 0x00}, {0x7D, 0xB5, 0x00}, // 40-43
+	{0x00, 0xB5, 0x00}, {0x00, 0xB5, 0x71}, {0x00, 0xB5, 0xB5}, {0x00, 0x63, 0xB5}, // 44-47
+	{0x00, 0x00, 0xB5}, {0x75, 0x00, 0xB5}, {0xB5, 0x00, 0xB5}, {0xB5, 0x00, 0x6B}, // 48-51
+	{0xFF, 0x00, 0x00}, {0xFF, 0x8C, 0x00}, {0xFF, 0xFF, 0x00}, {0xB2, 0xFF, 0x00}, // 52-55
+	{0x00, 0xFF, 0x00}, {0x00, 0xFF, 0xA0}, {0x00, 0xFF, 0xFF}, {0x00, 0x8C, 0xFF}, // 56-59
+	{0x00, 0x00, 0xFF}, {0xA5, 0x00, 0xFF}, {0xFF, 0x00, 0xFF}, {0xFF, 0x00, 0x98}, // 60-63
+	{0xFF, 0x59, 0x59}, {0xFF, 0xB4, 0x59}, {0xFF, 0xFF, 0x71}, {0xCF, 0xFF, 0x60}, // 64-67
+	{0x6F, 0xFF, 0x6F}, {0x65, 0xFF, 0xC9}, {0x6D, 0xFF, 0xFF}, {0x59, 0xB4, 0xFF}, // 68-71
+	{0x59, 0x59, 0xFF}, {0xC4, 0x59, 0xFF}, {0xFF, 0x66, 0xFF}, {0xFF, 0x59, 0xBC}, // 72-75
+	{0xFF, 0x9C, 0x9C}, {0xFF, 0xD3, 0x9C}, {0xFF, 0xFF, 0x9C}, {0xE2, 0xFF, 0x9C}, // 76-79
+	{0x9C, 0xFF, 0x9C}, {0x9C, 0xFF, 0xDB}, {0x9C, 0xFF, 0xFF}, {0x9C, 0xD3, 0xFF}, // 80-83
+	{0x9C, 0x9C, 0xFF}, {0xDC, 0x9C, 0xFF}, {0xFF, 0x9C, 0xFF}, {0xFF, 0x94, 0xD3}, // 84-87
+	{0x00, 0x00, 0x00}, {0x13, 0x13, 0x13}, {0x28, 0x28, 0x28}, {0x36, 0x36, 0x36}, // 88-91
+	{0x4D, 0x4D, 0x4D}, {0x65, 0x65, 0x65}, {0x81, 0x81, 0x81}, {0x9F, 0x9F, 0x9F}, // 92-95
+	{0xBC, 0xBC, 0xBC}, {0xE2, 0xE2, 0xE2}, {0xFF, 0xFF, 0xFF}, // 96-98
+}
+
+// rgbColorFlag marks a `color` as holding an arbitrary 0xRRGGBB value rather than a palette entry
+const rgbColorFlag color = 1 << 24
+
+// rgbColor returns a `color` representing an arbitrary RGB value
+func rgbColor(r, g, b uint8) color {
+	return rgbColorFlag | color(r)<<16 | color(g)<<8 | color(b)
+}
+
+// isRGB returns whether `c` holds an arbitrary RGB value rather than a palette entry
+func (c color) isRGB() bool {
+	return (c & rgbColorFlag) != 0
+}
+
+// RGB returns the red, green and blue components of `c`
+// The default color has no fixed value, so `ok` is false for it
+func (c color) RGB() (r, g, b uint8, ok bool) {
+	if c.isRGB() {
+		return uint8(c >> 16), uint8(c >> 8), uint8(c), true
+	}
+	if c <= Default || c > numColors {
+		return 0, 0, 0, false
+	}
+	rgb := colorRGB[c-1]
+	return rgb[0], rgb[1], rgb[2], true
+}
+
+// nearestColor returns the palette color in the range [first, last] nearest to `c`
+// Colors without an RGB value are returned unchanged
+func (c color) nearestColor(first, last color) color {
+	r, g, b, ok := c.RGB()
+	if !ok {
+		return c
+	}
+	target := [3]uint8{r, g, b}
+
+	minDistance := uint32(0xFFFFFFFF)
+	minColor := Default
+	for col := first; col <= last; col++ {
+		if distance := colorDistance(target, colorRGB[col-1]); distance < minDistance {
+			minDistance = distance
+			minColor = col
+		}
+	}
+
+	return minColor
+}
+
+// paletteColor returns the palette color nearest to `c`, or `c` itself if it is already in the palette
+// Invalid colors are treated as the default color
+func (c color) paletteColor() color {
+	if c.isRGB() {
+		return c.nearestColor(White, numColors)
+	}
+	if c < Default || c > numColors {
+		return Default
+	}
+	return c
+}
+
+// NearestReadableIRCColor returns the number of the IRC color nearest to `rgb`, a 0xRRGGBB value
+// Only the basic colors excluding white and black are considered, since those are readable on any background
+func NearestReadableIRCColor(rgb int) int {
+	col := rgbColor(uint8(rgb>>16), uint8(rgb>>8), uint8(rgb)).nearestColor(Blue, LightGrey)
+	return int(col - 1)
+}
+
+// colorDistance returns the squared distance between two RGB colors
+func colorDistance(a, b [3]uint8) (distance uint32) {
+	for index := range a {
+		distance += squaredDifference(a[index], b[index])
+	}
+	return
+}
+
+func squaredDifference(a, b uint8) (diff uint32) {
+	if a > b {
+		diff = uint32(a - b)
+	} else {
+		diff = uint32(b - a)
+	}
+
+	diff *= diff
+	return
+}
+
 // Span represents a piece of text with a single format
 type Span struct {
 	Text       string
@@ -64,3 +189,52 @@ func (s Span) IsZeroColor() bool {
 
 // FormattedString represents a string made up of `Span`s
 type FormattedString []Span
+
+// invisibleOnSpaces are the formats which make no visible difference to text made up only of spaces
+const invisibleOnSpaces = Bold | Italic
+
+// Normalize returns a copy of `fs` with empty spans dropped and adjacent spans merged where their formatting is equal,
+// or differs only in ways that can't be seen, such as bold spaces
+// All the renderers normalize their input first, so they never emit redundant formatting codes
+func (fs FormattedString) Normalize() FormattedString {
+	out := FormattedString{}
+	for _, span := range fs {
+		if span.Text == "" {
+			continue
+		}
+
+		if len(out) != 0 {
+			last := &out[len(out)-1]
+			if last.sameFormat(span) || (isSpaces(span.Text) && span.looksLikeOnSpaces(*last)) {
+				last.Text += span.Text
+				continue
+			}
+			if isSpaces(last.Text) && last.looksLikeOnSpaces(span) {
+				*last = span.withText(last.Text + span.Text)
+				continue
+			}
+		}
+
+		out = append(out, span)
+	}
+	return out
+}
+
+// sameFormat returns whether `s` and `other` have exactly the same formatting
+func (s Span) sameFormat(other Span) bool {
+	return s.Format == other.Format && s.Foreground == other.Foreground && s.Background == other.Background
+}
+
+// looksLikeOnSpaces returns whether text made up only of spaces would look the same with the formatting of `s` or `other`
+func (s Span) looksLikeOnSpaces(other Span) bool {
+	if (s.Format&^invisibleOnSpaces) != (other.Format&^invisibleOnSpaces) || s.Background != other.Background {
+		return false
+	}
+
+	// The foreground color is only visible on spaces in the lines drawn by underline and strikethrough
+	return s.Foreground == other.Foreground || (s.Format&(Underline|Strikethrough)) == None
+}
+
+func isSpaces(s string) bool {
+	return strings.TrimLeft(s, " ") == ""
+}
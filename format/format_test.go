@@ -1,6 +1,132 @@
 package format
 
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
 type testCase struct {
 	raw        string
 	structured FormattedString
 }
+
+func TestColorRGB(t *testing.T) {
+	Convey("When color.RGB is used", t, func() {
+		cases := []struct {
+			color  color
+			rgb    [3]uint8
+			hasRGB bool
+		}{
+			{Default, [3]uint8{}, false},
+			{White, [3]uint8{0xFF, 0xFF, 0xFF}, true},
+			{Black, [3]uint8{0x00, 0x00, 0x00}, true},
+			{LightGrey, [3]uint8{0xD2, 0xD2, 0xD2}, true},
+			{color(17), [3]uint8{0x47, 0x00, 0x00}, true},
+			{color(99), [3]uint8{0xFF, 0xFF, 0xFF}, true},
+			{color(100), [3]uint8{}, false},
+			{rgbColor(0x12, 0x34, 0x56), [3]uint8{0x12, 0x34, 0x56}, true},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %d is used", c.color), func() {
+				r, g, b, ok := c.color.RGB()
+				So(ok, ShouldEqual, c.hasRGB)
+				So([3]uint8{r, g, b}, ShouldResemble, c.rgb)
+			})
+		}
+	})
+}
+
+func TestNearestReadableIRCColor(t *testing.T) {
+	Convey("When NearestReadableIRCColor is used", t, func() {
+		cases := []struct {
+			rgb   int
+			color int
+		}{
+			{0x000000, 2},
+			{0xFFFFFF, 15},
+			{0xFF0000, 4},
+			{0x7289DA, 14},
+			{0x00FF00, 9},
+			{0x0000FF, 12},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %06x is used", c.rgb), func() {
+				So(NearestReadableIRCColor(c.rgb), ShouldEqual, c.color)
+			})
+		}
+	})
+}
+
+func TestNormalize(t *testing.T) {
+	Convey("When Normalize is used", t, func() {
+		cases := []struct {
+			input  FormattedString
+			output FormattedString
+		}{
+			{FormattedString{}, FormattedString{}},
+			{FormattedString{
+				{"", Bold, Default, Default},
+			}, FormattedString{}},
+			{FormattedString{
+				{"foo", Bold, Red, Default},
+				{"", Italic, Default, Default},
+				{"bar", Bold, Red, Default},
+			}, FormattedString{
+				{"foobar", Bold, Red, Default},
+			}},
+			{FormattedString{
+				{"foo", Bold, Default, Default},
+				{" ", None, Default, Default},
+				{"bar", Italic, Default, Default},
+			}, FormattedString{
+				{"foo ", Bold, Default, Default},
+				{"bar", Italic, Default, Default},
+			}},
+			{FormattedString{
+				{"  ", None, Default, Default},
+				{"foo", Bold | Italic, Red, Default},
+			}, FormattedString{
+				{"  foo", Bold | Italic, Red, Default},
+			}},
+			{FormattedString{
+				{"foo", Underline, Red, Default},
+				{" ", Underline, Default, Default},
+				{"bar", Underline, Red, Default},
+			}, FormattedString{
+				{"foo", Underline, Red, Default},
+				{" ", Underline, Default, Default},
+				{"bar", Underline, Red, Default},
+			}},
+			{FormattedString{
+				{"foo", None, Default, Default},
+				{" ", None, Default, Blue},
+				{" ", Monospace, Default, Default},
+			}, FormattedString{
+				{"foo", None, Default, Default},
+				{" ", None, Default, Blue},
+				{" ", Monospace, Default, Default},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.input), func() {
+				So(c.input.Normalize(), ShouldResemble, c.output)
+			})
+		}
+	})
+
+	Convey("When a FormattedString with redundant spans is rendered", t, func() {
+		fs := FormattedString{
+			{"foo", Bold, Default, Default},
+			{"bar", Bold, Default, Default},
+			{" ", None, Default, Default},
+			{"baz", Bold, Default, Default},
+		}
+		So(fs.RenderIRC(), ShouldEqual, "\x02foobar baz")
+		So(fs.RenderDiscord(), ShouldEqual, "**foobar baz**\uFEFF")
+	})
+}
@@ -0,0 +1,210 @@
+//go:build go1.18
+// +build go1.18
+
+package format
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// allFormats has every format bit set
+const allFormats = Bold | Italic | Underline | Strikethrough | Spoiler | Monospace | Reverse
+
+// spansFromFuzz builds a FormattedString from arbitrary fuzz input, so the renderers can be fuzzed with any spans
+// Each span is encoded as a format byte, foreground and background bytes, a length byte and then that much text
+func spansFromFuzz(data []byte) FormattedString {
+	fs := FormattedString{}
+	for len(data) >= 4 {
+		span := Span{
+			Format:     format(data[0]) & allFormats,
+			Foreground: colorFromFuzz(data[1]),
+			Background: colorFromFuzz(data[2]),
+		}
+
+		n := int(data[3])
+		data = data[4:]
+		if n > len(data) {
+			n = len(data)
+		}
+		span.Text = string(data[:n])
+		data = data[n:]
+
+		fs = append(fs, span)
+	}
+	return fs
+}
+
+// colorFromFuzz maps a byte to the default color, a palette color or an RGB color
+func colorFromFuzz(b byte) color {
+	if b <= numColors {
+		return color(b)
+	}
+	return rgbColor(b, b*7, b*13)
+}
+
+// withoutIRCCodes returns `fs` with any IRC formatting characters removed from its text, since those can't be
+// rendered as text
+func withoutIRCCodes(fs FormattedString) FormattedString {
+	out := FormattedString{}
+	for _, span := range fs {
+		text := []byte{}
+		for _, c := range []byte(span.Text) {
+			if !isIRCCode(c) {
+				text = append(text, c)
+			}
+		}
+		span.Text = string(text)
+		out = append(out, span)
+	}
+	return out
+}
+
+func isIRCCode(c byte) bool {
+	_, ok := ircFormatChars[c]
+	return ok || c == ircColor[0] || c == ircHexColor[0] || c == ircReset[0]
+}
+
+func FuzzParseIRC(f *testing.F) {
+	for _, seed := range []string{
+		"", "foo", "\x03", "\x04", "\x0f", "\x0302,01foo\x03,bar", "\x03,", "\x0399,99", "\x04FF8000,00ff80",
+		"\x02\x1d\x1f\x1e\x11\x16foo", "\x03\x02\x021bar", "ΨΩΔ", "\xff\xfe",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		fs := ParseIRC(s)
+
+		for _, span := range fs {
+			if span.Text == "" || withoutIRCCodes(FormattedString{span})[0] != span {
+				t.Errorf("ParseIRC(%q) produced a span with no text or a formatting code in its text: %+v", s, fs)
+			}
+		}
+
+		// Rendering a parsed message must give a message which parses to the same thing, if not the same bytes
+		if rendered := fs.RenderIRC(); !equalSpans(ParseIRC(rendered).Normalize(), fs.ircSpans()) {
+			t.Errorf("ParseIRC(%q) renders as %q, which parses as %+v, expected %+v", s, rendered, ParseIRC(rendered), fs)
+		}
+	})
+}
+
+// fuzzNonstandardColorRegex matches an IRC color code with a missing color number
+var fuzzNonstandardColorRegex = regexp.MustCompile(`\x03,|\x03\d\d?,(\D|$)`)
+
+func FuzzRenderIRC(f *testing.F) {
+	f.Add([]byte("\x01\x00\x00\x00\x01\x00\x00\x03foo"))
+	f.Add([]byte("\x10\x00\x00\x03foo\x00\xc8\x10\x03bar"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := withoutIRCCodes(spansFromFuzz(data))
+		rendered := fs.RenderIRC()
+
+		// IRC can't show everything, but what it can show must survive the round-trip
+		if parsed := ParseIRC(rendered); !equalSpans(parsed, fs.ircSpans()) {
+			t.Errorf("%+v renders as %q, which parses as %+v, expected %+v", fs, rendered, parsed, fs.ircSpans())
+		}
+
+		// Color codes must be understood by other clients too, which don't all accept a missing color number
+		if code := fuzzNonstandardColorRegex.FindString(rendered); code != "" {
+			t.Errorf("%+v renders as %q, which has the nonstandard color code %q", fs, rendered, code)
+		}
+
+		for _, line := range fs.SplitIRC(64) {
+			if n := len(line.RenderIRC()); n > 64 && utf8.RuneCountInString(line.RenderPlain()) > 1 {
+				t.Errorf("%+v split into a line of %d bytes: %+v", fs, n, line)
+			}
+		}
+	})
+}
+
+func FuzzParseDiscord(f *testing.F) {
+	for _, seed := range []string{
+		"", "foo", "**foo**", "*foo*", "__foo__", "_foo_", "~~foo~~", "||foo||", "`foo`", "``foo ` bar``",
+		"***foo***", "**foo *bar* baz**", "\\*foo\\*", "http://example.com/_foo_", "*", "**", "`", "\uFEFF",
+		"```go\nfoo\n```", "foo ```bar", "``````", "**\uFEFF**", "\xff\xfe",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		fs := ParseDiscord(s)
+		for _, span := range fs {
+			if span.Text == "" {
+				t.Errorf("ParseDiscord(%q) produced an empty span: %+v", s, fs)
+			}
+		}
+
+		fs.RenderDiscord()
+
+		for _, block := range SplitDiscordCodeBlocks(s) {
+			if block.Code != nil {
+				block.Code.RenderDiscord()
+				block.Code.FormattedLines()
+			}
+		}
+	})
+}
+
+func FuzzRenderDiscord(f *testing.F) {
+	f.Add([]byte("\x01\x00\x00\x03foo\x00\x00\x00\x03 ba\x02\x00\x00\x01r"))
+	f.Add([]byte("\x20\x00\x00\x06foo`ba\x10\x00\x00\x03***"))
+	f.Add([]byte("\x08\x00\x00\x03foo\x08\x00\x00\x01\\"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := spansFromFuzz(data)
+
+		if !utf8.ValidString(fs.RenderPlain()) || strings.ContainsRune(fs.RenderPlain(), '\uFEFF') {
+			return
+		}
+		for _, span := range fs {
+			// Inline code in unformatted text is passed through for Discord to display
+			if (span.Format&discordFormats) == None && strings.Contains(span.Text, "`") {
+				return
+			}
+		}
+
+		// Formatting may not survive, but the text must
+		rendered := fs.RenderDiscord()
+		if parsed := ParseDiscord(rendered); parsed.RenderPlain() != fs.RenderPlain() {
+			t.Errorf("%+v renders as %q, which parses as %+v", fs, rendered, parsed)
+		}
+	})
+}
+
+func FuzzRenderers(f *testing.F) {
+	f.Add([]byte("\x7f\x05\x03\x03foo\x00\x00\x00\x00\x00\xc8\xff\x03<b>"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := spansFromFuzz(data)
+		if plain := fs.RenderPlain(); plain != strings.Join(spanTexts(fs), "") {
+			t.Errorf("%+v renders as plain text %q", fs, plain)
+		}
+		fs.RenderHTML()
+		fs.RenderANSI()
+		fs.DiscordANSICodeBlock().RenderDiscord()
+	})
+}
+
+// equalSpans returns whether two FormattedStrings are identical, treating nil and empty as equal
+func equalSpans(a, b FormattedString) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func spanTexts(fs FormattedString) []string {
+	texts := []string{}
+	for _, span := range fs {
+		texts = append(texts, span.Text)
+	}
+	return texts
+}
@@ -0,0 +1,63 @@
+package format
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// htmlTags are the HTML elements used for each format, outermost first
+var htmlTags = []struct {
+	format format
+	open   string
+	close  string
+}{
+	{Spoiler, `<span class="spoiler">`, "</span>"},
+	{Strikethrough, "<s>", "</s>"},
+	{Underline, "<u>", "</u>"},
+	{Bold, "<b>", "</b>"},
+	{Italic, "<i>", "</i>"},
+	{Monospace, "<code>", "</code>"},
+}
+
+// RenderHTML renders a FormattedString into HTML, suitable for inclusion in a web page
+// Colors are rendered as inline styles, and spoilers are given the "spoiler" class for the page to style
+func (fs FormattedString) RenderHTML() string {
+	output := ""
+	for _, span := range fs.Normalize() {
+		openTags := ""
+		closeTags := ""
+
+		if style := span.htmlStyle(); style != "" {
+			openTags += `<span style="` + style + `">`
+			closeTags = "</span>" + closeTags
+		}
+
+		for _, tag := range htmlTags {
+			if (span.Format & tag.format) != 0 {
+				openTags += tag.open
+				closeTags = tag.close + closeTags
+			}
+		}
+
+		output += openTags + html.EscapeString(span.Text) + closeTags
+	}
+	return output
+}
+
+// htmlStyle returns the CSS needed to display the colors of `s`
+func (s Span) htmlStyle() string {
+	fg, bg := s.Foreground, s.Background
+	if (s.Format & Reverse) != 0 {
+		fg, bg = bg, fg
+	}
+
+	styles := []string{}
+	if r, g, b, ok := fg.RGB(); ok {
+		styles = append(styles, fmt.Sprintf("color:#%02x%02x%02x", r, g, b))
+	}
+	if r, g, b, ok := bg.RGB(); ok {
+		styles = append(styles, fmt.Sprintf("background-color:#%02x%02x%02x", r, g, b))
+	}
+	return strings.Join(styles, ";")
+}
@@ -0,0 +1,47 @@
+package format
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRenderHTML(t *testing.T) {
+	Convey("When RenderHTML is used", t, func() {
+		cases := []testCase{
+			{"", []Span{}},
+			{"foo", []Span{
+				{"foo", None, Default, Default},
+			}},
+			{"<b>foo</b>bar<i>baz</i>", []Span{
+				{"foo", Bold, Default, Default},
+				{"bar", None, Default, Default},
+				{"baz", Italic, Default, Default},
+			}},
+			{"<u><b><i>foo</i></b></u><s><code>bar</code></s>", []Span{
+				{"foo", Bold | Italic | Underline, Default, Default},
+				{"bar", Strikethrough | Monospace, Default, Default},
+			}},
+			{`<span class="spoiler">foo</span>`, []Span{
+				{"foo", Spoiler, Default, Default},
+			}},
+			{`<span style="color:#00007f;background-color:#000000">foo</span><span style="color:#123456">bar</span>`, []Span{
+				{"foo", None, Blue, Black},
+				{"bar", None, rgbColor(0x12, 0x34, 0x56), Default},
+			}},
+			{`<span style="color:#ffffff;background-color:#ff0000"><b>foo</b></span>`, []Span{
+				{"foo", Bold | Reverse, BrightRed, White},
+			}},
+			{"&lt;script&gt;&amp;&#34;ΨΩΔ&#34;", []Span{
+				{"<script>&\"ΨΩΔ\"", None, Default, Default},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.structured), func() {
+				So(c.structured.RenderHTML(), ShouldEqual, c.raw)
+			})
+		}
+	})
+}
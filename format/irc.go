@@ -4,25 +4,39 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	ircColor = "\x03"
-
-	ircReset     = "\x0f"
-	ircBold      = "\x02"
-	ircUnderline = "\x1f"
-	ircItalic    = "\x1d"
+	ircColor    = "\x03"
+	ircHexColor = "\x04"
+
+	ircReset         = "\x0f"
+	ircBold          = "\x02"
+	ircUnderline     = "\x1f"
+	ircItalic        = "\x1d"
+	ircStrikethrough = "\x1e"
+	ircMonospace     = "\x11"
+	ircReverse       = "\x16"
+
+	// ircDefaultColor is the color specifier some clients use to explicitly select the default color
+	ircDefaultColor = 99
 )
 
 var ircFormatChars = map[byte]format{
 	'\x02': Bold,
 	'\x1f': Underline,
 	'\x1d': Italic,
+	'\x1e': Strikethrough,
+	'\x11': Monospace,
+	'\x16': Reverse,
 }
 
+// spoilerColor is used for both foreground and background of spoilers, since IRC has no spoiler format
+const spoilerColor = Black
+
 // ParseIRC parses an incoming IRC message into a FormattedString
 func ParseIRC(s string) FormattedString {
 	spans := []Span{}
@@ -35,7 +49,7 @@ func ParseIRC(s string) FormattedString {
 	for i := 0; i < len(data); i++ {
 		c := data[i]
 
-		if _, ok := ircFormatChars[c]; !ok && c != '\x03' && c != '\x0f' {
+		if _, ok := ircFormatChars[c]; !ok && c != '\x03' && c != '\x04' && c != '\x0f' {
 			currentStr = append(currentStr, c)
 			continue
 		}
@@ -46,16 +60,17 @@ func ParseIRC(s string) FormattedString {
 			spans = append(spans, currentSpan)
 		}
 
-		if formatCode, ok := ircFormatChars[c]; ok {
-			currentSpan.Format ^= formatCode
-		} else if c == '\x0f' {
+		switch c {
+		case '\x0f':
 			currentSpan.Format = None
 			currentSpan.Foreground = Default
 			currentSpan.Background = Default
-		} else if c == '\x03' {
+		case '\x03':
 			i += parseIRCColorCode(data[i+1:], &currentSpan)
-		} else {
-			panic("invalid code reached")
+		case '\x04':
+			i += parseIRCHexColorCode(data[i+1:], &currentSpan)
+		default:
+			currentSpan.Format ^= ircFormatChars[c]
 		}
 	}
 
@@ -94,15 +109,45 @@ func parseIRCColorCode(data []byte, currentSpan *Span) (length int) {
 
 	if len(colorCode[2]) != 0 { // If comma was found
 		if fgSpecifier != -1 {
-			currentSpan.Foreground = color(fgSpecifier + 1)
+			currentSpan.Foreground = specifierToColor(fgSpecifier)
 		}
 
-		currentSpan.Background = color(bgSpecifier + 1)
+		currentSpan.Background = specifierToColor(bgSpecifier)
 	} else {
 		if fgSpecifier == -1 {
 			currentSpan.Background = Default
 		}
-		currentSpan.Foreground = color(fgSpecifier + 1)
+		currentSpan.Foreground = specifierToColor(fgSpecifier)
+	}
+
+	return len(colorCode[0])
+}
+
+var ircHexColorCode = regexp.MustCompile("([0-9A-Fa-f]{6})?(,([0-9A-Fa-f]{6}))?")
+
+func parseIRCHexColorCode(data []byte, currentSpan *Span) (length int) {
+	colorCode := ircHexColorCode.FindSubmatch(data)
+
+	parse := func(hex []byte) color {
+		rgb, err := strconv.ParseUint(string(hex), 16, 32)
+		if err != nil {
+			log.Errorf("failed to convert %q to an integer, despite matching hex color code regex: %s", hex, err)
+			return Default
+		}
+		return rgbColor(uint8(rgb>>16), uint8(rgb>>8), uint8(rgb))
+	}
+
+	if len(colorCode[2]) != 0 { // If comma was found
+		if len(colorCode[1]) != 0 {
+			currentSpan.Foreground = parse(colorCode[1])
+		}
+
+		currentSpan.Background = parse(colorCode[3])
+	} else if len(colorCode[1]) != 0 {
+		currentSpan.Foreground = parse(colorCode[1])
+	} else {
+		currentSpan.Foreground = Default
+		currentSpan.Background = Default
 	}
 
 	return len(colorCode[0])
@@ -113,7 +158,7 @@ func (fs FormattedString) RenderIRC() string { // nolint: gocyclo
 	output := ""
 
 	var lastSpan Span
-	for _, span := range fs {
+	for _, span := range fs.ircSpans() {
 		if span.IsZeroFormat() && !lastSpan.IsZeroFormat() {
 			output += ircReset + span.Text
 			lastSpan = span
@@ -130,26 +175,34 @@ func (fs FormattedString) RenderIRC() string { // nolint: gocyclo
 		if (formatChanges & Underline) != 0 {
 			output += ircUnderline
 		}
+		if (formatChanges & Strikethrough) != 0 {
+			output += ircStrikethrough
+		}
+		if (formatChanges & Monospace) != 0 {
+			output += ircMonospace
+		}
+		if (formatChanges & Reverse) != 0 {
+			output += ircReverse
+		}
 
+		colorCode := ""
 		if span.IsZeroColor() && !lastSpan.IsZeroColor() {
-			output += ircColor
-
-			if !isByteSafeAfterIncompleteColor(span.Text[0]) {
-				output += ircBold + ircBold
-			}
-		} else if span.Foreground != lastSpan.Foreground && span.Background != lastSpan.Background {
+			colorCode = ircColor
+		} else if span.Background != lastSpan.Background {
+			// Not every client accepts a background without a foreground, so both are always given
 			fgSpecifier := colorToSpecifier(span.Foreground)
 			bgSpecifier := colorToSpecifier(span.Background)
 
-			output += ircColor + fgSpecifier + "," + bgSpecifier
+			colorCode = ircColor + fgSpecifier + "," + bgSpecifier
 		} else if span.Foreground != lastSpan.Foreground {
 			fgSpecifier := colorToSpecifier(span.Foreground)
 
-			output += ircColor + fgSpecifier
-		} else if span.Background != lastSpan.Background {
-			bgSpecifier := colorToSpecifier(span.Background)
+			colorCode = ircColor + fgSpecifier
+		}
 
-			output += ircColor + "," + bgSpecifier
+		output += colorCode
+		if !isTextSafeAfterColorCode(colorCode, span.Text) {
+			output += ircBold + ircBold
 		}
 
 		output += span.Text
@@ -159,13 +212,71 @@ func (fs FormattedString) RenderIRC() string { // nolint: gocyclo
 	return output
 }
 
+// ircSpans returns the spans of `fs` as IRC can display them, normalized
+// Spoilers are shown with matching foreground and background colors, and RGB colors with the nearest palette color
+func (fs FormattedString) ircSpans() FormattedString {
+	spans := FormattedString{}
+	for _, span := range fs {
+		span = span.withSpoilerColors().withPaletteColors()
+		span.Format &^= Spoiler
+		spans = append(spans, span)
+	}
+	return spans.Normalize()
+}
+
+// withSpoilerColors returns `s` with the foreground and background set to the same color if it is a spoiler,
+// hiding the text until it is highlighted
+func (s Span) withSpoilerColors() Span {
+	if (s.Format & Spoiler) == 0 {
+		return s
+	}
+
+	if s.Foreground == Default {
+		s.Foreground = spoilerColor
+	}
+	s.Background = s.Foreground
+	return s
+}
+
+// specifierToColor converts an IRC color number to a `color`; -1 represents an absent specifier
+func specifierToColor(n int) color {
+	if n < 0 || n == ircDefaultColor {
+		return Default
+	}
+	return color(n + 1)
+}
+
+// withPaletteColors returns `s` with any RGB colors replaced by the nearest color in the IRC palette
+func (s Span) withPaletteColors() Span {
+	s.Foreground = s.Foreground.paletteColor()
+	s.Background = s.Background.paletteColor()
+	return s
+}
+
+// colorToSpecifier converts a `color` to an IRC color number
+// An empty specifier isn't a reliable way to select the default color, so it is selected explicitly
 func colorToSpecifier(c color) string {
 	if c == Default {
-		return ""
+		return strconv.Itoa(ircDefaultColor)
 	}
 	return fmt.Sprintf("%02d", c-1)
 }
 
-func isByteSafeAfterIncompleteColor(c byte) bool {
-	return !(('0' <= c && c <= '9') || c == ',')
+// isTextSafeAfterColorCode returns whether `text` can directly follow the color code `colorCode` without being read
+// as part of it
+func isTextSafeAfterColorCode(colorCode, text string) bool {
+	if colorCode == "" || text == "" {
+		return true
+	}
+
+	c := text[0]
+	if colorCode == ircColor || strings.HasSuffix(colorCode, ",") {
+		// The code may be continued by a color number, or a comma and a background color
+		return !(('0' <= c && c <= '9') || c == ',')
+	}
+	if !strings.Contains(colorCode, ",") {
+		// The code may be continued by a comma and a background color
+		return c != ','
+	}
+	return true
 }
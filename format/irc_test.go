@@ -50,6 +50,29 @@ func TestParseIRC(t *testing.T) {
 				{"foo", Bold | Italic | Underline, Blue, Black},
 				{"bar", Bold | Italic | Underline, Default, Default},
 			}},
+			{"\x1efoo\x11bar\x1e\x11baz", []Span{
+				{"foo", Strikethrough, Default, Default},
+				{"bar", Strikethrough | Monospace, Default, Default},
+				{"baz", None, Default, Default},
+			}},
+			{"\x16foo\x16bar", []Span{
+				{"foo", Reverse, Default, Default},
+				{"bar", None, Default, Default},
+			}},
+			{"\x0352,88foo\x0399bar\x0304,99baz", []Span{
+				{"foo", None, color(53), color(89)},
+				{"bar", None, Default, color(89)},
+				{"baz", None, BrightRed, Default},
+			}},
+			{"\x04FF8000foo\x04,00ff80bar\x04baz", []Span{
+				{"foo", None, rgbColor(0xFF, 0x80, 0x00), Default},
+				{"bar", None, rgbColor(0xFF, 0x80, 0x00), rgbColor(0x00, 0xFF, 0x80)},
+				{"baz", None, Default, Default},
+			}},
+			{"\x04123456,foo\x0412345xbar", []Span{
+				{",foo", None, rgbColor(0x12, 0x34, 0x56), Default},
+				{"12345xbar", None, Default, Default},
+			}},
 			{"ΨΩΔ", []Span{
 				{"ΨΩΔ", None, Default, Default},
 			}},
@@ -73,7 +96,7 @@ func TestRenderIRC(t *testing.T) {
 			{"\x0302,01foo", []Span{
 				{"foo", None, Blue, Black},
 			}},
-			{"\x0302,01foo\x03,bar", []Span{
+			{"\x0302,01foo\x0302,99bar", []Span{
 				{"foo", None, Blue, Black},
 				{"bar", None, Blue, Default},
 			}},
@@ -85,7 +108,7 @@ func TestRenderIRC(t *testing.T) {
 				{"foo", None, Blue, Black},
 				{"bar", None, Black, Black},
 			}},
-			{"\x0302,01foo\x03,02bar", []Span{
+			{"\x0302,01foo\x0302,02bar", []Span{
 				{"foo", None, Blue, Black},
 				{"bar", None, Blue, Blue},
 			}},
@@ -110,6 +133,26 @@ func TestRenderIRC(t *testing.T) {
 				{"foo", Bold, Blue, Black},
 				{"1bar", Bold, Default, Default},
 			}},
+			{"\x0304,02foo\x0399bar", []Span{
+				{"foo", None, BrightRed, Blue},
+				{"bar", None, Default, Blue},
+			}},
+			{"\x0304foo\x0303\x02\x02,bar", []Span{
+				{"foo", None, BrightRed, Default},
+				{",bar", None, Green, Default},
+			}},
+			{"\x0304,02foo\x0304,991bar", []Span{
+				{"foo", None, BrightRed, Blue},
+				{"1bar", None, BrightRed, Default},
+			}},
+			{"\x02\x1e\x11foo\x0fbar", []Span{
+				{"foo", Bold | Strikethrough | Monospace, Default, Default},
+				{"bar", None, Default, Default},
+			}},
+			{"\x16\x0316,98foo\x0fbar", []Span{
+				{"foo", Reverse, color(17), color(99)},
+				{"bar", None, Default, Default},
+			}},
 			{"ΨΩΔ", []Span{
 				{"ΨΩΔ", None, Default, Default},
 			}},
@@ -123,5 +166,22 @@ func TestRenderIRC(t *testing.T) {
 				So(ParseIRC(c.structured.RenderIRC()), ShouldResemble, c.structured)
 			})
 		}
+
+		Convey("When RGB colors are used", func() {
+			So(FormattedString{
+				{"foo", None, rgbColor(0xFF, 0x10, 0x10), Default},
+				{"bar", None, rgbColor(0xFE, 0x00, 0x00), rgbColor(0x01, 0x01, 0x01)},
+				{"baz", None, rgbColor(0x40, 0x20, 0x00), Default},
+			}.RenderIRC(), ShouldEqual, "\x0304foo\x0304,01bar\x0317,99baz")
+		})
+
+		Convey("When a spoiler is used", func() {
+			So(FormattedString{
+				{"foo", None, Default, Default},
+				{"bar", Spoiler, Default, Default},
+				{"baz", Spoiler, Red, Default},
+				{"quux", None, Default, Default},
+			}.RenderIRC(), ShouldEqual, "foo\x0301,01bar\x0305,05baz\x0fquux")
+		})
 	})
 }
@@ -0,0 +1,10 @@
+package format
+
+// RenderPlain renders a FormattedString into plain text, with all formatting stripped
+func (fs FormattedString) RenderPlain() string {
+	output := ""
+	for _, span := range fs {
+		output += span.Text
+	}
+	return output
+}
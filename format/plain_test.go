@@ -0,0 +1,33 @@
+package format
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRenderPlain(t *testing.T) {
+	Convey("When RenderPlain is used", t, func() {
+		cases := []testCase{
+			{"", []Span{}},
+			{"foo", []Span{
+				{"foo", None, Default, Default},
+			}},
+			{"foo bar baz", []Span{
+				{"foo", Bold | Italic | Underline, Blue, Black},
+				{" bar ", Strikethrough | Spoiler | Monospace | Reverse, Default, Default},
+				{"baz", None, rgbColor(0x12, 0x34, 0x56), Default},
+			}},
+			{"*_<ΨΩΔ>_*", []Span{
+				{"*_<ΨΩΔ>_*", Bold, Default, Default},
+			}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is used", c.structured), func() {
+				So(c.structured.RenderPlain(), ShouldEqual, c.raw)
+			})
+		}
+	})
+}
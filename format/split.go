@@ -0,0 +1,143 @@
+package format
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// SplitIRC splits a FormattedString into lines which each take at most `maxBytes` bytes when rendered with RenderIRC
+// Lines are broken between words where possible, dropping the spaces at the break, and any formatting active at a
+// break is opened again at the start of the next line. A word too long for a line of its own is broken between
+// characters, never inside one.
+func (fs FormattedString) SplitIRC(maxBytes int) []FormattedString {
+	lines := []FormattedString{}
+
+	line := FormattedString{}
+	for _, word := range fs.words() {
+		// Trailing spaces are dropped if the line is broken after this word, so they don't need to fit
+		if candidate := line.appendSpans(word); len(candidate.trimRightSpaces().RenderIRC()) <= maxBytes {
+			line = candidate
+			continue
+		}
+
+		if len(line) != 0 {
+			if trimmed := line.trimRightSpaces(); len(trimmed) != 0 {
+				lines = append(lines, trimmed)
+			}
+			line = FormattedString{}
+
+			if len(word.trimRightSpaces().RenderIRC()) <= maxBytes {
+				line = word
+				continue
+			}
+		}
+
+		// The word doesn't fit on a line of its own, so break it up
+		for _, char := range word.chars() {
+			candidate := line.appendSpans(char)
+			if len(line) != 0 && len(candidate.RenderIRC()) > maxBytes {
+				if trimmed := line.trimRightSpaces(); len(trimmed) != 0 {
+					lines = append(lines, trimmed)
+				}
+				candidate = char
+			}
+			line = candidate
+		}
+	}
+
+	if trimmed := line.trimRightSpaces(); len(trimmed) != 0 {
+		lines = append(lines, trimmed)
+	}
+
+	return lines
+}
+
+// words splits `fs` into words, each followed by the spaces after it
+// A word may be made up of several spans, if its formatting changes part-way through
+func (fs FormattedString) words() []FormattedString {
+	words := []FormattedString{}
+
+	word := FormattedString{}
+	inSpaces := false
+	for _, span := range fs {
+		text := span.Text
+		for text != "" {
+			if !inSpaces {
+				end := strings.IndexByte(text, ' ')
+				if end == -1 {
+					end = len(text)
+				} else {
+					inSpaces = true
+				}
+				word = word.appendSpans(FormattedString{span.withText(text[:end])})
+				text = text[end:]
+				continue
+			}
+
+			spaces := len(text) - len(strings.TrimLeft(text, " "))
+			word = word.appendSpans(FormattedString{span.withText(text[:spaces])})
+			text = text[spaces:]
+
+			if text != "" {
+				words = append(words, word)
+				word = FormattedString{}
+				inSpaces = false
+			}
+		}
+	}
+
+	if len(word) != 0 {
+		words = append(words, word)
+	}
+
+	return words
+}
+
+// chars splits `fs` into its individual characters
+func (fs FormattedString) chars() []FormattedString {
+	chars := []FormattedString{}
+	for _, span := range fs {
+		for text := span.Text; text != ""; {
+			_, n := utf8.DecodeRuneInString(text)
+			chars = append(chars, FormattedString{span.withText(text[:n])})
+			text = text[n:]
+		}
+	}
+	return chars
+}
+
+// appendSpans returns a copy of `fs` with `spans` appended, merging adjacent spans with the same formatting
+func (fs FormattedString) appendSpans(spans FormattedString) FormattedString {
+	out := append(FormattedString{}, fs...)
+	for _, span := range spans {
+		if span.Text == "" {
+			continue
+		}
+		if len(out) != 0 && out[len(out)-1].sameFormat(span) {
+			out[len(out)-1].Text += span.Text
+		} else {
+			out = append(out, span)
+		}
+	}
+	return out
+}
+
+// trimRightSpaces returns a copy of `fs` with any trailing spaces removed
+func (fs FormattedString) trimRightSpaces() FormattedString {
+	out := append(FormattedString{}, fs...)
+	for len(out) != 0 {
+		last := &out[len(out)-1]
+		last.Text = strings.TrimRight(last.Text, " ")
+		if last.Text != "" {
+			break
+		}
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// withText returns a copy of `s` with its text replaced by `text`
+func (s Span) withText(text string) Span {
+	s.Text = text
+	return s
+}
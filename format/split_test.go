@@ -0,0 +1,85 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSplitIRC(t *testing.T) {
+	Convey("When SplitIRC is used", t, func() {
+		cases := []struct {
+			maxBytes int
+			input    FormattedString
+			lines    []string
+		}{
+			{10, FormattedString{}, []string{}},
+			{10, FormattedString{
+				{"foo bar", None, Default, Default},
+			}, []string{"foo bar"}},
+			{10, FormattedString{
+				{"foo bar baz quux", None, Default, Default},
+			}, []string{"foo bar", "baz quux"}},
+			{10, FormattedString{
+				{"foo   bar  ", None, Default, Default},
+				{"baz", Bold, Default, Default},
+			}, []string{"foo   bar", "\x02baz"}},
+			{10, FormattedString{
+				{"foo ", Bold, Default, Default},
+				{"bar baz", Bold | Italic, Default, Default},
+			}, []string{"\x02foo \x1dbar", "\x02\x1dbaz"}},
+			{10, FormattedString{
+				{"foo bar", None, Blue, Black},
+			}, []string{"\x0302,01foo", "\x0302,01bar"}},
+			{10, FormattedString{
+				{"foobarbazquux", None, Default, Default},
+			}, []string{"foobarbazq", "uux"}},
+			{10, FormattedString{
+				{"a ΨΩΔΨΩΔ", Bold, Default, Default},
+			}, []string{"\x02a", "\x02ΨΩΔΨ", "\x02ΩΔ"}},
+			{10, FormattedString{
+				{"  foo", None, Default, Default},
+			}, []string{"  foo"}},
+			{10, FormattedString{
+				{"foo", None, Default, Default},
+				{"bar", Italic, Default, Default},
+				{"baz", None, Default, Default},
+			}, []string{"foo\x1dbar\x0fba", "z"}},
+		}
+
+		for _, c := range cases {
+			Convey(fmt.Sprintf("When %+v is split to %d bytes", c.input, c.maxBytes), func() {
+				lines := []string{}
+				for _, line := range c.input.SplitIRC(c.maxBytes) {
+					lines = append(lines, line.RenderIRC())
+				}
+				So(lines, ShouldResemble, c.lines)
+			})
+		}
+	})
+
+	Convey("When SplitIRC is used on a long message", t, func() {
+		input := FormattedString{
+			{strings.Repeat("foo bar ", 50), Bold, Default, Default},
+			{strings.Repeat("ΨΩΔ ", 50), Underline, Red, Default},
+			{strings.Repeat("x", 100), None, Default, Default},
+		}
+
+		for _, maxBytes := range []int{10, 50, 400} {
+			Convey(fmt.Sprintf("When it is split to %d bytes", maxBytes), func() {
+				lines := input.SplitIRC(maxBytes)
+
+				text := ""
+				for _, line := range lines {
+					So(len(line.RenderIRC()), ShouldBeLessThanOrEqualTo, maxBytes)
+					text += line.RenderPlain()
+				}
+
+				// only the spaces at line breaks are dropped, but there's no easy way to tell which those are
+				So(strings.Replace(text, " ", "", -1), ShouldEqual, strings.Replace(input.RenderPlain(), " ", "", -1))
+			})
+		}
+	})
+}